@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dotenvFile is the name of the file containing the references of a job's images
+const dotenvFile = "image.env"
+
+// outputFiles is a temporary directory for files produced by a job, which can be uploaded as
+// artifacts
+type outputFiles struct {
+	dir string
+}
+
+func newOutputFiles() (*outputFiles, error) {
+	dir, err := ioutil.TempDir("", "docker-runner-files")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create directory for job files: %v", err)
+	}
+	return &outputFiles{dir: dir}, nil
+}
+
+// Create creates the file name, replacing an existing one
+func (f *outputFiles) Create(name string) (*os.File, error) {
+	return os.Create(filepath.Join(f.dir, filepath.Base(name)))
+}
+
+func (f *outputFiles) WriteFile(name string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(f.dir, filepath.Base(name)), data, 0644)
+}
+
+// Match returns the sorted names of the files matching any of paths. Paths are path.Match
+// patterns, "." matches all files.
+func (f *outputFiles) Match(paths ArtifactPaths) ([]string, error) {
+	infos, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		for _, pattern := range paths {
+			pattern = path.Clean(strings.TrimPrefix(pattern, "./"))
+			if ok, _ := path.Match(pattern, info.Name()); ok || pattern == "." {
+				names = append(names, info.Name())
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Close removes all files
+func (f *outputFiles) Close() error {
+	return os.RemoveAll(f.dir)
+}
+
+// WriteArchive writes the files names to w in the given format. zip and the default format
+// create a zip archive, gzip a gzip member per file and raw the content of a single file.
+func (f *outputFiles) WriteArchive(w io.Writer, format ArtifactFormat, names []string) error {
+	switch format {
+	case ArtifactFormatZip, ArtifactFormatDefault:
+		archive := zip.NewWriter(w)
+		for _, name := range names {
+			if err := f.copyTo(name, func(info os.FileInfo) (io.Writer, error) {
+				header, err := zip.FileInfoHeader(info)
+				if err != nil {
+					return nil, err
+				}
+				header.Method = zip.Deflate
+				return archive.CreateHeader(header)
+			}); err != nil {
+				return err
+			}
+		}
+		return archive.Close()
+	case ArtifactFormatGzip:
+		for _, name := range names {
+			gz := gzip.NewWriter(w)
+			gz.Name = name
+			if err := f.copyTo(name, func(info os.FileInfo) (io.Writer, error) {
+				gz.ModTime = info.ModTime()
+				return gz, nil
+			}); err != nil {
+				return err
+			}
+			if err := gz.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ArtifactFormatRaw:
+		if len(names) != 1 {
+			return fmt.Errorf("Raw artifacts must contain exactly one file, got %d", len(names))
+		}
+		return f.copyTo(names[0], func(os.FileInfo) (io.Writer, error) { return w, nil })
+	default:
+		return fmt.Errorf("Artifact format %q is not supported", format)
+	}
+}
+
+// copyTo copies the file name to the writer returned by open
+func (f *outputFiles) copyTo(name string, open func(os.FileInfo) (io.Writer, error)) error {
+	file, err := os.Open(filepath.Join(f.dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := open(info)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// artifactUpload describes how the files of an artifact are uploaded
+type artifactUpload struct {
+	files   []string
+	name    string
+	options ArtifactOptions
+}
+
+// newArtifactUpload selects the files of an artifact and names the upload. It returns nil if no
+// files match. dotenv reports always contain the job's image references, regardless of their paths.
+func newArtifactUpload(job *JobResponse, artifact Artifact, files *outputFiles) (*artifactUpload, error) {
+	upload := &artifactUpload{
+		options: ArtifactOptions{
+			Type:     artifact.Type,
+			Format:   artifact.Format,
+			ExpireIn: artifact.ExpireIn,
+		},
+	}
+	if upload.options.Type == "" {
+		upload.options.Type = "archive"
+	}
+	report := upload.options.Type != "archive"
+	if upload.options.Format == ArtifactFormatDefault {
+		upload.options.Format = ArtifactFormatZip
+		if report {
+			upload.options.Format = ArtifactFormatGzip
+		}
+	}
+
+	var err error
+	if artifact.Type == "dotenv" {
+		upload.files, err = files.Match(ArtifactPaths{dotenvFile})
+	} else {
+		upload.files, err = files.Match(artifact.Paths)
+	}
+	if err != nil || len(upload.files) == 0 {
+		return nil, err
+	}
+
+	name := job.Variables.ExpandValue(artifact.Name)
+	if name == "" {
+		name = "artifacts"
+	}
+	if report && len(artifact.Paths) == 1 {
+		// Reports are named after their file
+		name = path.Base(artifact.Paths[0])
+	} else if artifact.Type == "dotenv" {
+		name = dotenvFile
+	}
+	switch upload.options.Format {
+	case ArtifactFormatZip:
+		upload.name = name + ".zip"
+	case ArtifactFormatGzip:
+		upload.name = name + ".gz"
+	default:
+		upload.name = upload.files[0]
+	}
+	return upload, nil
+}
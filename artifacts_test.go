@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFiles(t *testing.T) {
+	files, err := newOutputFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	assert.NoError(t, files.WriteFile("image.env", []byte("IMAGE=a\n")))
+	assert.NoError(t, files.WriteFile("metadata.json", []byte("{}")))
+	assert.NoError(t, files.WriteFile("../escape.json", []byte("{}")), "Files should not be written outside of the directory")
+
+	names, err := files.Match(ArtifactPaths{"*.json", "./image.env"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"escape.json", "image.env", "metadata.json"}, names)
+	names, err = files.Match(ArtifactPaths{"."})
+	assert.NoError(t, err)
+	assert.Len(t, names, 3)
+	names, err = files.Match(ArtifactPaths{"other"})
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	var buf bytes.Buffer
+	assert.NoError(t, files.WriteArchive(&buf, ArtifactFormatZip, []string{"image.env", "metadata.json"}))
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if assert.NoError(t, err) && assert.Len(t, archive.File, 2) {
+		assert.Equal(t, "image.env", archive.File[0].Name)
+		f, err := archive.File[0].Open()
+		assert.NoError(t, err)
+		content, _ := ioutil.ReadAll(f)
+		assert.Equal(t, "IMAGE=a\n", string(content))
+	}
+
+	buf.Reset()
+	assert.NoError(t, files.WriteArchive(&buf, ArtifactFormatGzip, []string{"image.env", "metadata.json"}))
+	gz, err := gzip.NewReader(&buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "image.env", gz.Name)
+		content, _ := ioutil.ReadAll(gz)
+		assert.Equal(t, "IMAGE=a\n{}", string(content), "Every file should be a gzip member")
+	}
+
+	buf.Reset()
+	assert.NoError(t, files.WriteArchive(&buf, ArtifactFormatRaw, []string{"metadata.json"}))
+	assert.Equal(t, "{}", buf.String())
+	assert.Error(t, files.WriteArchive(&buf, ArtifactFormatRaw, []string{"image.env", "metadata.json"}), "Raw artifacts can only contain one file")
+	assert.Error(t, files.WriteArchive(&buf, "tar", []string{"image.env"}))
+
+	dir := files.dir
+	assert.NoError(t, files.Close())
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "Close should remove the files")
+}
+
+func TestNewArtifactUpload(t *testing.T) {
+	files, err := newOutputFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	files.WriteFile("image.env", []byte("IMAGE=a\n"))
+	files.WriteFile("metadata.json", []byte("{}"))
+
+	job := testJob(JobVariable{Key: "CI_JOB_NAME", Value: "build"})
+	upload, err := newArtifactUpload(job, Artifact{Name: "$CI_JOB_NAME-files", Paths: ArtifactPaths{"*"}, ExpireIn: "1 day"}, files)
+	assert.NoError(t, err)
+	assert.Equal(t, &artifactUpload{
+		files:   []string{"image.env", "metadata.json"},
+		name:    "build-files.zip",
+		options: ArtifactOptions{Type: "archive", Format: ArtifactFormatZip, ExpireIn: "1 day"},
+	}, upload)
+
+	upload, err = newArtifactUpload(job, Artifact{Type: "dotenv", Paths: ArtifactPaths{"deploy.env"}}, files)
+	assert.NoError(t, err)
+	assert.Equal(t, &artifactUpload{
+		files:   []string{"image.env"},
+		name:    "deploy.env.gz",
+		options: ArtifactOptions{Type: "dotenv", Format: ArtifactFormatGzip},
+	}, upload, "dotenv reports should contain the image references")
+
+	upload, err = newArtifactUpload(job, Artifact{Type: "metadata", Format: ArtifactFormatRaw, Paths: ArtifactPaths{"metadata.json"}}, files)
+	assert.NoError(t, err)
+	assert.Equal(t, "metadata.json", upload.name)
+
+	upload, err = newArtifactUpload(job, Artifact{Paths: ArtifactPaths{"missing"}}, files)
+	assert.NoError(t, err)
+	assert.Nil(t, upload, "Artifacts without files should not be uploaded")
+}
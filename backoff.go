@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially growing delays with jitter for retrying failed operations. The
+// zero value is not usable, Min and Max need to be set.
+type backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt uint
+}
+
+// Next returns the delay before the next attempt. The delay doubles with every call until Max is
+// reached and is randomly reduced by up to half so that runners don't retry in lockstep.
+func (b *backoff) Next() time.Duration {
+	d := b.Max
+	if b.attempt < 32 && b.Min<<b.attempt < b.Max {
+		d = b.Min << b.attempt
+	}
+	b.attempt++
+	if d < 2 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// Reset starts over with the minimum delay, it should be called after a successful attempt
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
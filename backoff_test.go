@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{Min: time.Second, Max: 10 * time.Second}
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		d := b.Next()
+		assert.True(t, d > max*time.Second/2 && d <= max*time.Second, "Delay %d should be in (%v, %v], got %v", i, max*time.Second/2, max*time.Second, d)
+	}
+	for i := 0; i < 100; i++ {
+		assert.True(t, b.Next() <= 10*time.Second, "Delay should never exceed Max")
+	}
+	b.Reset()
+	assert.True(t, b.Next() <= time.Second, "Delay should start at Min after Reset")
+}
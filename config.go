@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the runner configuration, either read from the file in CONFIG_FILE or assembled from
+// the environment variables documented in the README.
+type Config struct {
+	// ShutdownGracePeriod is how long running jobs are waited for on SIGTERM/SIGINT
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+	// ListenAddress is where metrics and health checks are served. Changes need a restart.
+	ListenAddress string         `yaml:"listen_address"`
+	Runners       []RunnerConfig `yaml:"runners"`
+}
+
+// RunnerConfig describes a single runner registered with a GitLab instance
+type RunnerConfig struct {
+	// Name identifies the runner in logs and across reloads. Defaults to the GitLab host.
+	Name      string `yaml:"name"`
+	URL       string `yaml:"url"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	// Registry is the registry images are pushed to. If empty the GitLab registry is used.
+	Registry string `yaml:"registry"`
+	// Concurrent is the maximum number of jobs run at the same time, defaults to 10. It is a
+	// pointer so that an explicit 0 can be rejected.
+	Concurrent *int `yaml:"concurrent"`
+	// OutputLimit is the maximum size of a job's trace in kilobytes, output beyond it is dropped
+	OutputLimit int `yaml:"output_limit"`
+	// AllowedProjects restricts the projects the runner builds for. Entries are project paths
+	// and may contain path.Match patterns. If empty all projects are allowed.
+	AllowedProjects []string    `yaml:"allowed_projects"`
+	Build           BuildConfig `yaml:"build"`
+}
+
+// BuildConfig contains default options for all image builds of a runner
+type BuildConfig struct {
+	// PullParent makes sure base images are up-to-date, defaults to true
+	PullParent  *bool  `yaml:"pull_parent"`
+	NoCache     bool   `yaml:"no_cache"`
+	CPUShares   int64  `yaml:"cpu_shares"`
+	Memory      int64  `yaml:"memory"`
+	NetworkMode string `yaml:"network_mode"`
+}
+
+var registryHostFormat = regexp.MustCompile(`^[a-z0-9.-]+(:[0-9]+)?$`)
+
+const (
+	defaultConcurrent          = 10
+	defaultShutdownGracePeriod = 25 * time.Second
+	defaultListenAddress       = ":9252"
+	defaultOutputLimit         = 4096
+)
+
+// LoadConfig reads, validates and fills in defaults for the configuration file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config: %v", err)
+	}
+	var config Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Failed to parse config: %v", err)
+	}
+	if err := config.prepare(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ConfigFromEnv builds a single-runner configuration from environment variables
+func ConfigFromEnv() (*Config, error) {
+	config := Config{
+		ListenAddress: os.Getenv("LISTEN_ADDRESS"),
+		Runners: []RunnerConfig{{
+			URL:       os.Getenv("GITLAB_URL"),
+			Token:     os.Getenv("GITLAB_RUNNER_TOKEN"),
+			TokenFile: os.Getenv("GITLAB_RUNNER_TOKEN_FILE"),
+			Registry:  os.Getenv("REGISTRY"),
+		}},
+	}
+	var err error
+	if os.Getenv("SHUTDOWN_GRACE_PERIOD") != "" {
+		config.ShutdownGracePeriod, err = time.ParseDuration(os.Getenv("SHUTDOWN_GRACE_PERIOD"))
+		if err != nil {
+			return nil, fmt.Errorf("SHUTDOWN_GRACE_PERIOD is not a duration: %v", err)
+		}
+	}
+	if os.Getenv("CONCURRENT") != "" {
+		concurrent, err := strconv.Atoi(os.Getenv("CONCURRENT"))
+		if err != nil {
+			return nil, errors.New("CONCURRENT is not a number")
+		}
+		config.Runners[0].Concurrent = &concurrent
+	}
+	if os.Getenv("OUTPUT_LIMIT") != "" {
+		config.Runners[0].OutputLimit, err = strconv.Atoi(os.Getenv("OUTPUT_LIMIT"))
+		if err != nil {
+			return nil, errors.New("OUTPUT_LIMIT is not a number")
+		}
+	}
+	if err := config.prepare(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// prepare fills in defaults, reads token files and validates the configuration
+func (c *Config) prepare() error {
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return errors.New("shutdown_grace_period must not be negative")
+	}
+	if c.ListenAddress == "" {
+		c.ListenAddress = defaultListenAddress
+	}
+	if len(c.Runners) == 0 {
+		return errors.New("No runners are configured")
+	}
+	names := make(map[string]bool)
+	for i := range c.Runners {
+		r := &c.Runners[i]
+		if err := r.prepare(); err != nil {
+			if r.Name == "" {
+				return fmt.Errorf("Runner %d: %v", i+1, err)
+			}
+			return fmt.Errorf("Runner %v: %v", r.Name, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("Runner name %v is used more than once", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+func (r *RunnerConfig) prepare() error {
+	if r.URL == "" {
+		return errors.New("GitLab URL is not set")
+	}
+	gitlabURL, err := url.Parse(r.URL)
+	if err != nil || (gitlabURL.Scheme != "http" && gitlabURL.Scheme != "https") || gitlabURL.Host == "" {
+		return fmt.Errorf("GitLab URL %q is not a valid http(s) URL", r.URL)
+	}
+	if r.Name == "" {
+		r.Name = gitlabURL.Host
+	}
+	if r.Token == "" && r.TokenFile != "" {
+		token, err := ioutil.ReadFile(r.TokenFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read runner token: %v", err)
+		}
+		r.Token = strings.TrimSpace(string(token))
+	}
+	if r.Token == "" {
+		return errors.New("Runner token is not set")
+	}
+	if r.Concurrent == nil {
+		concurrent := defaultConcurrent
+		r.Concurrent = &concurrent
+	}
+	if *r.Concurrent < 1 {
+		return errors.New("concurrent must be positive")
+	}
+	if r.OutputLimit == 0 {
+		r.OutputLimit = defaultOutputLimit
+	}
+	if r.OutputLimit < 0 {
+		return errors.New("output_limit must be positive")
+	}
+	if r.Registry != "" && !registryHostFormat.MatchString(r.Registry) {
+		return fmt.Errorf("Registry %q is not a valid registry host", r.Registry)
+	}
+	for _, pattern := range r.AllowedProjects {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Allowed project %q is not a valid pattern", pattern)
+		}
+	}
+	if r.Build.PullParent == nil {
+		pullParent := true
+		r.Build.PullParent = &pullParent
+	}
+	return nil
+}
+
+// ProjectAllowed checks if jobs of the project with the given path may run on this runner
+func (r *RunnerConfig) ProjectAllowed(projectPath string) bool {
+	if len(r.AllowedProjects) == 0 {
+		return true
+	}
+	for _, pattern := range r.AllowedProjects {
+		if ok, _ := path.Match(pattern, projectPath); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-runner-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(writeConfig(t, dir, `
+shutdown_grace_period: 10m
+runners:
+  - url: https://gitlab.example.com/
+    token: some-token
+    registry: registry.example.com
+    allowed_projects: [group/*, other/project]
+    build:
+      pull_parent: false
+      memory: 1073741824
+  - name: second
+    url: https://gitlab.example.org
+    token_file: `+tokenFile+`
+    concurrent: 2
+    output_limit: 100
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 10*time.Minute, config.ShutdownGracePeriod)
+	assert.Equal(t, defaultListenAddress, config.ListenAddress)
+	if !assert.Len(t, config.Runners, 2) {
+		return
+	}
+	first, second := config.Runners[0], config.Runners[1]
+	assert.Equal(t, "gitlab.example.com", first.Name, "Name should default to the GitLab host")
+	assert.Equal(t, defaultConcurrent, *first.Concurrent)
+	assert.False(t, *first.Build.PullParent)
+	assert.Equal(t, int64(1073741824), first.Build.Memory)
+	assert.True(t, first.ProjectAllowed("group/project"))
+	assert.True(t, first.ProjectAllowed("other/project"))
+	assert.False(t, first.ProjectAllowed("other/project2"))
+	assert.False(t, first.ProjectAllowed("group/sub/project"))
+	assert.Equal(t, "file-token", second.Token, "Token should be read from token_file")
+	assert.Equal(t, 2, *second.Concurrent)
+	assert.Equal(t, defaultOutputLimit, first.OutputLimit)
+	assert.Equal(t, 100, second.OutputLimit)
+	assert.True(t, *second.Build.PullParent, "pull_parent should default to true")
+	assert.True(t, second.ProjectAllowed("any/project"), "All projects should be allowed by default")
+
+	invalid := map[string]string{
+		"no runners":     `shutdown_grace_period: 1m`,
+		"unknown field":  "runners:\n  - url: https://gitlab.example.com\n    token: a\n    tokn: b\n",
+		"missing url":    "runners:\n  - token: a\n",
+		"invalid url":    "runners:\n  - url: gitlab.example.com\n    token: a\n",
+		"missing token":  "runners:\n  - url: https://gitlab.example.com\n",
+		"duplicate name": "runners:\n  - url: https://gitlab.example.com\n    token: a\n  - url: https://gitlab.example.com\n    token: b\n",
+		"concurrent":     "runners:\n  - url: https://gitlab.example.com\n    token: a\n    concurrent: -1\n",
+		"concurrent 0":   "runners:\n  - url: https://gitlab.example.com\n    token: a\n    concurrent: 0\n",
+		"output limit":   "runners:\n  - url: https://gitlab.example.com\n    token: a\n    output_limit: -1\n",
+		"registry":       "runners:\n  - url: https://gitlab.example.com\n    token: a\n    registry: https://registry.example.com\n",
+	}
+	for name, content := range invalid {
+		_, err := LoadConfig(writeConfig(t, dir, content))
+		assert.Error(t, err, "Config with %v should be rejected", name)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	os.Setenv("GITLAB_URL", "https://gitlab.example.com")
+	os.Setenv("GITLAB_RUNNER_TOKEN", "some-token")
+	defer os.Unsetenv("GITLAB_URL")
+	defer os.Unsetenv("GITLAB_RUNNER_TOKEN")
+	defer os.Unsetenv("CONCURRENT")
+
+	config, err := ConfigFromEnv()
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultConcurrent, *config.Runners[0].Concurrent, "CONCURRENT should default to 10 if unset")
+	}
+	os.Setenv("CONCURRENT", "3")
+	config, err = ConfigFromEnv()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, *config.Runners[0].Concurrent)
+	}
+	for _, concurrent := range []string{"0", "-1", "many"} {
+		os.Setenv("CONCURRENT", concurrent)
+		_, err = ConfigFromEnv()
+		assert.Error(t, err, "CONCURRENT=%v should be rejected", concurrent)
+	}
+}
@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+	"github.com/fatih/color"
+	"github.com/golang/glog"
+)
+
+var metaFmt = color.New(color.FgGreen, color.Bold)
+var failFmt = color.New(color.FgRed, color.Bold)
+
+// DockerAPI is the part of the Docker Engine API client used to build and push images
+type DockerAPI interface {
+	ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
+	ImagePush(ctx context.Context, image string, options types.ImagePushOptions) (io.ReadCloser, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registrytypes.DistributionInspect, error)
+	ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+	ImageTag(ctx context.Context, source, target string) error
+	ImageSave(ctx context.Context, images []string) (io.ReadCloser, error)
+}
+
+// GitlabAPI is the part of GitlabRunnerClient used to report the progress of a job
+type GitlabAPI interface {
+	UpdateJob(id int, req UpdateJobRequest) (bool, error)
+	PatchTrace(id int, token string, content []byte, startOffset int) (time.Duration, error)
+	UploadArtifact(id int, token string, name string, content io.Reader, options ArtifactOptions) error
+}
+
+// defaultTraceInterval is how often the trace is sent to GitLab if GitLab didn't suggest an interval
+const defaultTraceInterval = 5 * time.Second
+
+// clampTraceInterval limits the trace update interval suggested by GitLab to sane values
+func clampTraceInterval(interval time.Duration) time.Duration {
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+// maskedValues returns the secrets of a job which must not show up in its trace
+func maskedValues(job *JobResponse) []string {
+	values := append(job.Variables.Masked(), job.Token)
+	if password := job.Variables.Get("REGISTRY_PASSWORD"); password != "" {
+		values = append(values, password)
+	}
+	return values
+}
+
+// buildArgNameFormat matches the names allowed for build args
+var buildArgNameFormat = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// jobBuildArgs returns the build args requested by a job. Variables listed in BUILD_ARGS are passed
+// with their names, variables prefixed with BUILD_ARG_ without the prefix. Values are expanded.
+// Build args end up in the image's history, so they must not contain masked variables or the
+// registry password.
+func jobBuildArgs(job *JobResponse) (map[string]*string, error) {
+	variables := job.Variables.Expand()
+	secrets := job.Variables.Masked()
+	if password := job.Variables.Get("REGISTRY_PASSWORD"); password != "" {
+		secrets = append(secrets, password)
+	}
+	args := make(map[string]*string)
+	for _, name := range strings.Split(job.Variables.Get("BUILD_ARGS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !buildArgNameFormat.MatchString(name) {
+			return nil, fmt.Errorf("BUILD_ARGS contains the invalid name %q", name)
+		}
+		variable, ok := variables.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("BUILD_ARGS contains %v, which is not set", name)
+		}
+		value := variable.Value
+		args[name] = &value
+	}
+	for _, variable := range variables {
+		if !strings.HasPrefix(variable.Key, "BUILD_ARG_") {
+			continue
+		}
+		name := strings.TrimPrefix(variable.Key, "BUILD_ARG_")
+		if !buildArgNameFormat.MatchString(name) {
+			return nil, fmt.Errorf("%v is not a valid build arg variable", variable.Key)
+		}
+		value := variable.Value
+		args[name] = &value
+	}
+	for name, value := range args {
+		for _, secret := range secrets {
+			if secret != "" && strings.Contains(*value, secret) {
+				return nil, fmt.Errorf("Build arg %v contains a masked variable, which would be visible in the image's history", name)
+			}
+		}
+	}
+	return args, nil
+}
+
+// JobExecutor runs jobs: it builds and pushes their images with Docker and reports their trace and
+// state to GitLab.
+type JobExecutor struct {
+	docker DockerAPI
+	gitlab GitlabAPI
+	config RunnerConfig
+	// updateInterval is how often the job state is sent to GitLab, which also checks for
+	// cancellation. Unlike the trace interval it is fixed, GitLab only suggests an interval for
+	// trace patches (X-GitLab-Trace-Update-Interval) and not for job updates.
+	updateInterval time.Duration
+	// pushAttempts is how often pushing a tag is tried before the job fails, pushBackoff the
+	// delay between attempts
+	pushAttempts int
+	pushBackoff  backoff
+}
+
+func NewJobExecutor(docker DockerAPI, gitlab GitlabAPI, config RunnerConfig) *JobExecutor {
+	return &JobExecutor{
+		docker:         docker,
+		gitlab:         gitlab,
+		config:         config,
+		updateInterval: 5 * time.Second,
+		pushAttempts:   4,
+		pushBackoff:    backoff{Min: 2 * time.Second, Max: 30 * time.Second},
+	}
+}
+
+// Run executes a job and reports its trace and final state to GitLab. The job is failed when
+// killCtx is canceled.
+func (e *JobExecutor) Run(killCtx context.Context, job *JobResponse) (state JobState, reason JobFailureReason) {
+	traceBuf := NewTrace()
+	defer traceBuf.Close()
+	traceBuf.SetMasked(maskedValues(job))
+	traceBuf.SetLimit(e.config.OutputLimit * 1024)
+
+	// ctx gets canceled as soon as GitLab tells us that the job has been canceled, when the
+	// job timeout is exceeded or when the runner shuts down
+	ctx, cancel := context.WithCancel(killCtx)
+	defer cancel()
+	var canceled int32
+	timeout := job.Timeout()
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
+	// flushTrace sends the part of the trace GitLab doesn't have yet. It returns false if the trace
+	// needs to be sent again because GitLab has a different length than expected.
+	traceInterval := defaultTraceInterval
+	flushTrace := func() bool {
+		chunk, off := traceBuf.NextChunk()
+		interval, err := e.gitlab.PatchTrace(job.ID, job.Token, chunk, off)
+		if interval > 0 {
+			traceInterval = clampTraceInterval(interval)
+		}
+		var rangeErr *TraceRangeError
+		switch {
+		case err == nil:
+			traceBuf.CommitChunk()
+		case errors.As(err, &rangeErr):
+			tracePatchErrors.WithLabelValues(e.config.Name).Inc()
+			glog.Warningf("GitLab has %d bytes of the trace of job %v instead of %d, resending from there", rangeErr.RemoteOffset, job.ID, off)
+			traceBuf.Resync(rangeErr.RemoteOffset)
+			return false
+		default:
+			tracePatchErrors.WithLabelValues(e.config.Name).Inc()
+			traceBuf.AbortChunk()
+			glog.Warningf("Failed to update trace: %v", err)
+		}
+		return true
+	}
+
+	traceTimer := time.NewTimer(traceInterval)
+	updateTicker := time.NewTicker(e.updateInterval)
+	stopUpdates := make(chan struct{})
+	updatesStopped := make(chan struct{})
+	go func() {
+		defer close(updatesStopped)
+		for {
+			select {
+			case <-stopUpdates:
+				return
+			case <-traceTimer.C:
+				flushTrace()
+				traceTimer.Reset(traceInterval)
+				continue
+			case <-updateTicker.C:
+			}
+			abort, err := e.gitlab.UpdateJob(job.ID, UpdateJobRequest{
+				Token:         job.Token,
+				State:         Running,
+				FailureReason: NoneFailure,
+				Checksum:      traceBuf.Checksum(),
+			})
+			if err != nil {
+				glog.Warningf("Failed to update job: %v", err)
+			}
+			if abort {
+				glog.Infof("Job %v got canceled, aborting", job.ID)
+				atomic.StoreInt32(&canceled, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	// finish stops the trace updater, flushes the rest of the trace and reports the final
+	// state. Only the first call has any effect.
+	var finishOnce sync.Once
+	finish := func(finalState JobState, finalReason JobFailureReason) {
+		finishOnce.Do(func() {
+			state, reason = finalState, finalReason
+			jobsFinished.WithLabelValues(e.config.Name, string(state), string(reason)).Inc()
+			traceTimer.Stop()
+			updateTicker.Stop()
+			close(stopUpdates)
+			<-updatesStopped
+			traceBuf.Flush()
+			// Retry if GitLab answered 416 and the trace was resynced to its length
+			for i := 0; i < 3; i++ {
+				if flushTrace() {
+					break
+				}
+			}
+			_, err := e.gitlab.UpdateJob(job.ID, UpdateJobRequest{
+				Token:         job.Token,
+				State:         state,
+				FailureReason: reason,
+				Checksum:      traceBuf.Checksum(),
+			})
+			if err != nil {
+				glog.Warningf("Failed to update job: %v", err)
+			}
+		})
+	}
+
+	// files contains the files produced by the job, which are uploaded as artifacts. Artifacts are
+	// uploaded at most once, even if uploading them on success fails.
+	var files *outputFiles
+	var artifactsUploaded bool
+	uploadArtifacts := func(success bool) error {
+		if files == nil || artifactsUploaded {
+			return nil
+		}
+		artifactsUploaded = true
+		return e.uploadArtifacts(job, files, success, traceBuf)
+	}
+
+	fail := func(err error) {
+		if atomic.LoadInt32(&canceled) == 1 {
+			// GitLab keeps the job canceled, the failed state is only reported to finish it
+			failFmt.Fprintf(traceBuf, "\nJob was canceled\n")
+			finish(Failed, NoneFailure)
+			return
+		}
+		if killCtx.Err() != nil {
+			failFmt.Fprintf(traceBuf, "\nERROR: Job failed: runner is shutting down\n")
+			finish(Failed, RunnerSystemFailure)
+			return
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			failFmt.Fprintf(traceBuf, "\nERROR: Job failed: execution took longer than %v\n", timeout)
+			finish(Failed, JobExecutionTimeout)
+			return
+		}
+		failFmt.Fprintf(traceBuf, "%v", err)
+		if err := uploadArtifacts(false); err != nil {
+			failFmt.Fprintf(traceBuf, "\n%v", err)
+		}
+		// A registry which still fails after all retries is an outage outside of the job, reported
+		// as runner_system_failure so jobs can retry it with retry:when. api_failure is meant for
+		// the runner's requests to GitLab. Rejected pushes fail like the script.
+		var pushErr *pushError
+		if errors.As(err, &pushErr) && pushErr.Transient {
+			finish(Failed, RunnerSystemFailure)
+			return
+		}
+		finish(Failed, ScriptFailure)
+	}
+
+	if !e.config.ProjectAllowed(job.Variables.Get("CI_PROJECT_PATH")) {
+		fail(fmt.Errorf("Project %v is not allowed to use this runner", job.Variables.Get("CI_PROJECT_PATH")))
+		return
+	}
+
+	var err error
+	files, err = newOutputFiles()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer files.Close()
+
+	images, err := e.build(ctx, job, files, traceBuf)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = files.WriteFile(dotenvFile, dotenv(images))
+	}
+	if err == nil {
+		err = uploadArtifacts(true)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	finish(Success, NoneFailure)
+	return
+}
+
+// build resolves the registry and tags of a job, builds its image and pushes it. Saved images are
+// written to files. All output meant for the user is written to out. Errors are returned as-is, Run
+// decides how the job failed.
+func (e *JobExecutor) build(ctx context.Context, job *JobResponse, files *outputFiles, out io.Writer) ([]pushedImage, error) {
+	sections := newTraceSections(out, job.Features.TraceSections)
+	defer sections.EndAll()
+
+	// Registry
+	sections.Start("resolve_registry")
+	var gitlabRegistry bool
+	var registry string
+	if e.config.Registry == "" {
+		if job.Variables.Get("CI_REGISTRY") == "" {
+			return nil, errors.New("No Registry is specified")
+		}
+		registry = job.Variables.Get("CI_REGISTRY")
+		gitlabRegistry = true
+	} else {
+		registry = e.config.Registry
+	}
+
+	// Registry auth
+	var authConfig types.AuthConfig
+	if gitlabRegistry {
+		authConfig = types.AuthConfig{
+			Username: job.Variables.Get("CI_REGISTRY_USER"),
+			Password: job.Token,
+		}
+	} else if job.Variables.Get("REGISTRY_USER") != "" && job.Variables.Get("REGISTRY_PASSWORD") != "" {
+		authConfig = types.AuthConfig{
+			Username: job.Variables.Get("REGISTRY_USER"),
+			Password: job.Variables.Get("REGISTRY_PASSWORD"),
+		}
+	}
+
+	switch {
+	case gitlabRegistry:
+		metaFmt.Fprintf(out, "Using GitLab registry %v as %v\n", registry, authConfig.Username)
+	case authConfig != types.AuthConfig{}:
+		metaFmt.Fprintf(out, "Using registry %v as %v\n", registry, authConfig.Username)
+	default:
+		metaFmt.Fprintf(out, "Using registry %v without credentials\n", registry)
+	}
+	sections.End("resolve_registry")
+
+	// Image pull auth
+	authConfigs := map[string]types.AuthConfig{}
+	if (authConfig != types.AuthConfig{}) {
+		authConfigs[registry] = authConfig
+	}
+
+	skipExisting, err := job.Variables.Bool("SKIP_EXISTING")
+	if err != nil {
+		return nil, err
+	}
+	skipPush, err := job.Variables.Bool("SKIP_PUSH")
+	if err != nil {
+		return nil, err
+	}
+	save, err := saveFormat(job)
+	if err != nil {
+		return nil, err
+	}
+
+	var subBuildName string
+	var rootBuild bool
+	if job.Variables.Get("BUILD_DIR") != "" {
+
+		rootBuild, err = job.Variables.Bool("BUILD_FROM_ROOT")
+		if err != nil {
+			return nil, err
+		}
+
+		if job.Variables.Get("BUILD_NAME") != "" {
+			if registryInvalidChars.MatchString(job.Variables.Get("BUILD_NAME")) {
+				return nil, errors.New("BUILD_NAME contains non-alphanumeric or upper case characters. This is not supported by Docker.")
+			}
+			subBuildName = job.Variables.Get("BUILD_NAME")
+		} else {
+			subBuildName = registryInvalidChars.ReplaceAllString(strings.ToLower(job.Variables.Get("BUILD_DIR")), "")
+		}
+		subBuildName = fmt.Sprintf("/%v", subBuildName)
+	}
+
+	name, err := imageName(job)
+	if err != nil {
+		return nil, err
+	}
+	tagNames, err := imageTags(job)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := buildTargets(job)
+	if err != nil {
+		return nil, err
+	}
+
+	// Image Push auth
+	var dockerPushOptions types.ImagePushOptions
+	if (authConfig != types.AuthConfig{}) {
+		encodedAuthConfig, err := json.Marshal(authConfig)
+		if err != nil {
+			return nil, err
+		}
+		dockerPushOptions.RegistryAuth = base64.URLEncoding.EncodeToString(encodedAuthConfig)
+	} else {
+		dockerPushOptions.RegistryAuth = "force X-Registry-Auth"
+	}
+
+	buildArgs, err := jobBuildArgs(job)
+	if err != nil {
+		return nil, err
+	}
+	if job.Variables.Get("RELATIVE_FROM") != "" {
+		relativeFromTag := fmt.Sprintf("%v/%v/%v:%v", registry, name, job.Variables.Get("RELATIVE_FROM"), job.GitInfo.Sha)
+		buildArgs["RELATIVE_FROM"] = &relativeFromTag
+	}
+
+	labels, err := imageLabels(job, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	options := types.ImageBuildOptions{
+		RemoteContext: fmt.Sprintf("%v#%v:%v", job.GitInfo.RepoURL, job.GitInfo.Ref, job.Variables.Get("BUILD_DIR")),
+		PullParent:    *e.config.Build.PullParent,
+		NoCache:       e.config.Build.NoCache,
+		ForceRemove:   true,
+		CPUShares:     e.config.Build.CPUShares,
+		Memory:        e.config.Build.Memory,
+		NetworkMode:   e.config.Build.NetworkMode,
+		AuthConfigs:   authConfigs,
+		BuildArgs:     buildArgs,
+		Labels:        labels,
+	}
+	if rootBuild {
+		options.RemoteContext = fmt.Sprintf("%v#%v:%v", job.GitInfo.RepoURL, job.GitInfo.Ref, "")
+		options.Dockerfile = job.Variables.Get("BUILD_DIR") + "/Dockerfile"
+	}
+
+	// All images are built before anything is pushed, so a failing target doesn't leave the
+	// registry with only some of them updated
+	var pushTags, allTags []string
+	var images []pushedImage
+	for _, target := range targets {
+		var tags []string
+		for _, tagName := range tagNames {
+			tags = append(tags, fmt.Sprintf("%v/%v%v%v:%v", registry, name, subBuildName, target.suffix, tagName))
+		}
+		metaFmt.Fprintf(out, "Building %v on Docker CI Builder\n", tags[0])
+
+		options.Tags = tags
+		options.Target = target.name
+		existed, err := e.buildImage(ctx, options, dockerPushOptions.RegistryAuth, skipExisting, out, sections)
+		if err != nil {
+			return nil, err
+		}
+		if existed {
+			pushTags = append(pushTags, tags[1:]...)
+		} else {
+			pushTags = append(pushTags, tags...)
+		}
+		allTags = append(allTags, tags...)
+		images = append(images, pushedImage{
+			repository: fmt.Sprintf("%v/%v%v%v", registry, name, subBuildName, target.suffix),
+			tags:       tags,
+			suffix:     strings.TrimPrefix(target.suffix, "/"),
+		})
+	}
+	if save != "" {
+		if err := e.saveImage(ctx, job, allTags, save, files, out, sections); err != nil {
+			return nil, err
+		}
+	}
+	if skipPush {
+		return images, nil
+	}
+	digests, err := e.push(ctx, pushTags, dockerPushOptions, out, sections)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		for _, tag := range images[i].tags {
+			if digest := digests[tag]; digest != "" {
+				images[i].digest = digest
+			}
+		}
+	}
+	return images, nil
+}
+
+// buildImage builds the image described by options, whose first tag identifies the commit. If
+// skipExisting is set and that tag exists in the registry already, it is pulled instead and true is
+// returned.
+func (e *JobExecutor) buildImage(ctx context.Context, options types.ImageBuildOptions, registryAuth string, skipExisting bool, out io.Writer, sections *traceSections) (bool, error) {
+	registryTag := options.Tags[0]
+	if skipExisting {
+		exists, err := e.pullExisting(ctx, registryTag, options.Tags[1:], registryAuth, out, sections)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+
+	buildStart := time.Now()
+	res, err := e.docker.ImageBuild(ctx, nil, options)
+	if err != nil {
+		dockerAPIErrors.WithLabelValues("build").Inc()
+		glog.Error(err)
+		return false, err
+	}
+	defer res.Body.Close()
+	var auxErr error
+	aux := func(msg jsonmessage.JSONMessage) {
+		var result types.BuildResult
+		if err := json.Unmarshal(*msg.Aux, &result); err != nil {
+			auxErr = err
+			glog.Warningf("Failed to parse AUX: %v", err)
+			return
+		}
+	}
+	steps := &buildSections{traceSections: sections}
+	err = displayJSONMessages(res.Body, out, steps.message, aux)
+	if err != nil {
+		return false, err
+	}
+	sections.EndAll()
+	if auxErr != nil {
+		return false, auxErr
+	}
+	if ctx.Err() != nil {
+		// Don't push an image of a job which has been canceled after the build finished
+		return false, ctx.Err()
+	}
+	buildDuration.WithLabelValues(e.config.Name).Observe(time.Since(buildStart).Seconds())
+	image, _, err := e.docker.ImageInspectWithRaw(ctx, registryTag)
+	if err != nil {
+		dockerAPIErrors.WithLabelValues("inspect").Inc()
+		return false, fmt.Errorf("Failed to inspect built image: %v", err)
+	}
+	metaFmt.Fprintf(out, "Build successful: %v (%v)\n\n", image.ID, units.HumanSize(float64(image.Size)))
+	return false, nil
+}
+
+// missingImageErrors matches registry errors meaning that an image doesn't exist. The Docker daemon
+// passes unknown tags on as internal errors, so the status code alone doesn't tell.
+var missingImageErrors = regexp.MustCompile(`(?i)manifest unknown|not found`)
+
+// pullExisting checks if registryTag already exists in the registry. If so, it is pulled and
+// tagged with tags, so that only these need to be pushed instead of building the image again.
+// The Docker API can't add tags in the registry directly, pushing them needs the image locally.
+func (e *JobExecutor) pullExisting(ctx context.Context, registryTag string, tags []string, registryAuth string, out io.Writer, sections *traceSections) (bool, error) {
+	sections.Start("pull_existing_image")
+	defer sections.End("pull_existing_image")
+	inspect, err := e.docker.DistributionInspect(ctx, registryTag, registryAuth)
+	if err != nil {
+		if !errdefs.IsNotFound(err) && !missingImageErrors.MatchString(err.Error()) {
+			dockerAPIErrors.WithLabelValues("distribution_inspect").Inc()
+			return false, fmt.Errorf("Failed to check if %v exists in the registry: %v", registryTag, err)
+		}
+		glog.V(1).Infof("Failed to inspect %v in registry: %v", registryTag, err)
+		metaFmt.Fprintf(out, "%v does not exist in the registry yet, building it\n", registryTag)
+		return false, nil
+	}
+	metaFmt.Fprintf(out, "%v already exists in the registry (%v), skipping the build\n", registryTag, inspect.Descriptor.Digest)
+	res, err := e.docker.ImagePull(ctx, registryTag, types.ImagePullOptions{RegistryAuth: registryAuth})
+	if err != nil {
+		dockerAPIErrors.WithLabelValues("pull").Inc()
+		return false, err
+	}
+	defer res.Close()
+	if err := displayJSONMessages(res, out, nil, nil); err != nil {
+		return false, err
+	}
+	for _, tag := range tags {
+		if err := e.docker.ImageTag(ctx, registryTag, tag); err != nil {
+			dockerAPIErrors.WithLabelValues("tag").Inc()
+			return false, fmt.Errorf("Failed to tag %v: %v", tag, err)
+		}
+	}
+	return true, nil
+}
+
+// pushError is returned if pushing a tag failed, after retrying if the error was transient
+type pushError struct {
+	Tag string
+	Err error
+	// Transient is set if the registry didn't reject the push but kept failing until all attempts
+	// were used up
+	Transient bool
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("Failed to push %v: %v", e.Tag, e.Err)
+}
+
+func (e *pushError) Unwrap() error {
+	return e.Err
+}
+
+// permanentPushErrors matches registry errors which won't go away by retrying
+var permanentPushErrors = regexp.MustCompile(`(?i)denied|unauthorized|authentication required`)
+
+// push pushes tags, each in its own section. Failed pushes are retried with backoff, tags which
+// have been pushed already are not pushed again. It returns the digests the registry reported for
+// the tags.
+func (e *JobExecutor) push(ctx context.Context, tags []string, options types.ImagePushOptions, out io.Writer, sections *traceSections) (map[string]string, error) {
+	digests := make(map[string]string)
+	pushStart := time.Now()
+	for i, tag := range tags {
+		section := fmt.Sprintf("push_tag_%d", i+1)
+		sections.Start(section)
+		retry := e.pushBackoff
+		for attempt := 1; ; attempt++ {
+			digest, err := e.pushTag(ctx, tag, options, out)
+			if err == nil {
+				digests[tag] = digest
+				break
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if permanentPushErrors.MatchString(err.Error()) {
+				return nil, &pushError{Tag: tag, Err: err}
+			}
+			if attempt >= e.pushAttempts {
+				return nil, &pushError{Tag: tag, Err: err, Transient: true}
+			}
+			wait := retry.Next()
+			pushRetries.WithLabelValues(e.config.Name).Inc()
+			metaFmt.Fprintf(out, "\nPushing %v failed, retrying in %v (attempt %d of %d): %v\n", tag, wait.Round(time.Millisecond), attempt+1, e.pushAttempts, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		sections.End(section)
+	}
+
+	pushDuration.WithLabelValues(e.config.Name).Observe(time.Since(pushStart).Seconds())
+	metaFmt.Fprintf(out, "Image push successful")
+	return digests, nil
+}
+
+// pushTag pushes a single tag and returns the digest reported by the registry
+func (e *JobExecutor) pushTag(ctx context.Context, tag string, options types.ImagePushOptions, out io.Writer) (string, error) {
+	res, err := e.docker.ImagePush(ctx, tag, options)
+	if err != nil {
+		dockerAPIErrors.WithLabelValues("push").Inc()
+		return "", err
+	}
+	defer res.Close()
+	var digest string
+	var auxErr error
+	auxPush := func(msg jsonmessage.JSONMessage) {
+		var result types.PushResult
+		if err := json.Unmarshal(*msg.Aux, &result); err != nil {
+			auxErr = err
+			glog.Warningf("Failed to parse AUX: %v", err)
+			return
+		}
+		digest = result.Digest
+	}
+	if err := displayJSONMessages(res, out, nil, auxPush); err != nil {
+		return "", err
+	}
+	return digest, auxErr
+}
+
+// pushedImage is an image built or reused by a job
+type pushedImage struct {
+	repository string
+	// tags are full image references, the first one identifies the commit
+	tags   []string
+	digest string
+	// suffix is the name of the image's target if the job built multiple targets
+	suffix string
+}
+
+// dotenv formats the references of images as dotenv file, which GitLab passes to later jobs as
+// variables. The variables of images built from BUILD_TARGETS are suffixed with their target.
+func dotenv(images []pushedImage) []byte {
+	var buf bytes.Buffer
+	for _, image := range images {
+		var suffix string
+		if image.suffix != "" {
+			suffix = "_" + strings.ToUpper(dotenvInvalidChars.ReplaceAllString(image.suffix, "_"))
+		}
+		fmt.Fprintf(&buf, "IMAGE%v=%v\n", suffix, image.tags[0])
+		if image.digest != "" {
+			fmt.Fprintf(&buf, "IMAGE_DIGEST%v=%v\n", suffix, image.digest)
+			fmt.Fprintf(&buf, "IMAGE_REF%v=%v@%v\n", suffix, image.repository, image.digest)
+		}
+	}
+	return buf.Bytes()
+}
+
+var dotenvInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// uploadArtifacts uploads the artifacts of a job which are due depending on whether it succeeded
+func (e *JobExecutor) uploadArtifacts(job *JobResponse, files *outputFiles, success bool, out io.Writer) error {
+	for _, artifact := range job.Artifacts {
+		if (success && !artifact.When.OnSuccess()) || (!success && !artifact.When.OnFailure()) {
+			continue
+		}
+		upload, err := newArtifactUpload(job, artifact, files)
+		if err != nil {
+			return fmt.Errorf("Failed to collect artifact files: %v", err)
+		}
+		if upload == nil {
+			metaFmt.Fprintf(out, "\nNo files to upload for artifact %v\n", strings.Join(append([]string{artifact.Type}, artifact.Paths...), " "))
+			continue
+		}
+		metaFmt.Fprintf(out, "\nUploading %v artifact %v: %v\n", upload.options.Type, upload.name, strings.Join(upload.files, ", "))
+		content, w := io.Pipe()
+		go func() {
+			w.CloseWithError(files.WriteArchive(w, upload.options.Format, upload.files))
+		}()
+		err = e.gitlab.UploadArtifact(job.ID, job.Token, upload.name, content, upload.options)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/pkg/jsonmessage"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// fakeDocker implements DockerAPI in memory. Builds succeed and produce an image for every tag
+// unless configured otherwise.
+type fakeDocker struct {
+	m      sync.Mutex
+	builds []types.ImageBuildOptions
+	pushes []types.ImagePushOptions
+	// pushed contains the tags which were pushed successfully
+	pushed []string
+	// pulled contains the images which were pulled
+	pulled []string
+	// saved contains the images of every ImageSave call
+	saved  [][]string
+	images map[string]types.ImageInspect
+	// registry contains the images which have been pushed or exist in the registry already
+	registry map[string]types.ImageInspect
+
+	// buildOutput is streamed as build output, a successful build step is used if it is nil
+	buildOutput []jsonmessage.JSONMessage
+	// buildErr is returned by ImageBuild
+	buildErr error
+	// blockBuild makes the build output stream block until the context is canceled
+	blockBuild bool
+	// inspectErr is returned by DistributionInspect
+	inspectErr error
+	// pushErrors contains error messages streamed when pushing the respective tag
+	pushErrors map[string]string
+	// pushFailures is the number of pushes of a tag which fail with a registry outage before it
+	// can be pushed
+	pushFailures map[string]int
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		images:       make(map[string]types.ImageInspect),
+		registry:     make(map[string]types.ImageInspect),
+		pushErrors:   make(map[string]string),
+		pushFailures: make(map[string]int),
+	}
+}
+
+// jsonStream encodes messages like the Docker daemon streams progress
+func jsonStream(msgs ...jsonmessage.JSONMessage) io.ReadCloser {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			panic(err)
+		}
+	}
+	return ioutil.NopCloser(buf)
+}
+
+func auxMessage(v interface{}) jsonmessage.JSONMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	aux := json.RawMessage(data)
+	return jsonmessage.JSONMessage{Aux: &aux}
+}
+
+// blockingReader blocks reads until its context is done and then returns the context's error
+type blockingReader struct {
+	ctx context.Context
+}
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func (b blockingReader) Close() error {
+	return nil
+}
+
+func (f *fakeDocker) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.builds = append(f.builds, options)
+	if f.buildErr != nil {
+		return types.ImageBuildResponse{}, f.buildErr
+	}
+	if f.blockBuild {
+		return types.ImageBuildResponse{Body: blockingReader{ctx}}, nil
+	}
+	id := fmt.Sprintf("sha256:%064d", len(f.builds))
+	output := f.buildOutput
+	if output == nil {
+		output = []jsonmessage.JSONMessage{
+			{Stream: "Step 1/1 : FROM scratch\n"},
+			auxMessage(types.BuildResult{ID: id}),
+			{Stream: "Successfully built " + id[7:19] + "\n"},
+		}
+	}
+	for _, msg := range output {
+		if msg.Error != nil {
+			return types.ImageBuildResponse{Body: jsonStream(output...)}, nil
+		}
+	}
+	for _, tag := range options.Tags {
+		f.images[tag] = types.ImageInspect{ID: id, Size: 1024}
+	}
+	return types.ImageBuildResponse{Body: jsonStream(output...)}, nil
+}
+
+func (f *fakeDocker) ImagePush(ctx context.Context, image string, options types.ImagePushOptions) (io.ReadCloser, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.pushes = append(f.pushes, options)
+	img, ok := f.images[image]
+	if !ok {
+		return nil, fmt.Errorf("No such image: %v", image)
+	}
+	if f.pushFailures[image] > 0 {
+		f.pushFailures[image]--
+		msg := "received unexpected HTTP status: 502 Bad Gateway"
+		return jsonStream(
+			jsonmessage.JSONMessage{Status: "Preparing"},
+			jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: msg}, ErrorMessage: msg},
+		), nil
+	}
+	if msg, ok := f.pushErrors[image]; ok {
+		return jsonStream(
+			jsonmessage.JSONMessage{Status: "Preparing"},
+			jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: msg}, ErrorMessage: msg},
+		), nil
+	}
+	f.pushed = append(f.pushed, image)
+	f.registry[image] = img
+	return jsonStream(
+		jsonmessage.JSONMessage{Status: "Pushed"},
+		auxMessage(types.PushResult{Tag: image, Digest: "sha256:" + img.ID[7:], Size: int(img.Size)}),
+	), nil
+}
+
+func (f *fakeDocker) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img, ok := f.images[imageID]
+	if !ok {
+		return types.ImageInspect{}, nil, fmt.Errorf("No such image: %v", imageID)
+	}
+	return img, nil, nil
+}
+
+// fakeGitlabAPI implements GitlabAPI in memory for a single job
+type fakeGitlabAPI struct {
+	m       sync.Mutex
+	trace   bytes.Buffer
+	updates []UpdateJobRequest
+	// canceled makes UpdateJob report the job as canceled
+	canceled  bool
+	artifacts []uploadedArtifact
+	// uploadErr is returned by UploadArtifact
+	uploadErr error
+}
+
+// uploadedArtifact is an artifact received by a fake GitLab
+type uploadedArtifact struct {
+	Name    string
+	Options ArtifactOptions
+	Content []byte
+}
+
+// gunzip returns the decompressed content of a gzip artifact
+func (a uploadedArtifact) gunzip() string {
+	gz, err := gzip.NewReader(bytes.NewReader(a.Content))
+	if err != nil {
+		return err.Error()
+	}
+	content, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
+
+func (f *fakeGitlabAPI) UpdateJob(id int, req UpdateJobRequest) (bool, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.updates = append(f.updates, req)
+	return f.canceled, nil
+}
+
+func (f *fakeGitlabAPI) PatchTrace(id int, token string, content []byte, startOffset int) (time.Duration, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if startOffset != f.trace.Len() {
+		return 0, &TraceRangeError{RemoteOffset: f.trace.Len()}
+	}
+	f.trace.Write(content)
+	return 0, nil
+}
+
+func (f *fakeGitlabAPI) UploadArtifact(id int, token string, name string, content io.Reader, options ArtifactOptions) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.uploadErr != nil {
+		return f.uploadErr
+	}
+	f.artifacts = append(f.artifacts, uploadedArtifact{Name: name, Options: options, Content: data})
+	return nil
+}
+
+func (f *fakeGitlabAPI) lastUpdate() (UpdateJobRequest, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if len(f.updates) == 0 {
+		return UpdateJobRequest{}, errors.New("No updates")
+	}
+	return f.updates[len(f.updates)-1], nil
+}
+
+func (f *fakeDocker) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registrytypes.DistributionInspect, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.inspectErr != nil {
+		return registrytypes.DistributionInspect{}, f.inspectErr
+	}
+	img, ok := f.registry[image]
+	if !ok {
+		return registrytypes.DistributionInspect{}, fmt.Errorf("manifest unknown: %v", image)
+	}
+	var inspect registrytypes.DistributionInspect
+	inspect.Descriptor.Digest = digest.Digest("sha256:" + img.ID[7:])
+	return inspect, nil
+}
+
+func (f *fakeDocker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img, ok := f.registry[ref]
+	if !ok {
+		return nil, fmt.Errorf("manifest unknown: %v", ref)
+	}
+	f.pulled = append(f.pulled, ref)
+	f.images[ref] = img
+	return jsonStream(
+		jsonmessage.JSONMessage{Status: "Pulling from " + ref[:strings.LastIndex(ref, ":")], ID: ref[strings.LastIndex(ref, ":")+1:]},
+		jsonmessage.JSONMessage{Status: "Status: Downloaded newer image for " + ref},
+	), nil
+}
+
+func (f *fakeDocker) ImageTag(ctx context.Context, source, target string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img, ok := f.images[source]
+	if !ok {
+		return fmt.Errorf("No such image: %v", source)
+	}
+	f.images[target] = img
+	return nil
+}
+
+// ImageSave creates an archive like docker save with a config and a layer per image
+func (f *fakeDocker) ImageSave(ctx context.Context, images []string) (io.ReadCloser, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.saved = append(f.saved, images)
+	var files []tarFile
+	var manifest []dockerArchiveManifest
+	ids := make(map[string]int)
+	for _, ref := range images {
+		img, ok := f.images[ref]
+		if !ok {
+			return nil, fmt.Errorf("No such image: %v", ref)
+		}
+		if i, ok := ids[img.ID]; ok {
+			manifest[i].RepoTags = append(manifest[i].RepoTags, ref)
+			continue
+		}
+		ids[img.ID] = len(manifest)
+		id := img.ID[7:]
+		files = append(files,
+			tarFile{Name: id + "/layer.tar", Content: "layer of " + id},
+			tarFile{Name: id + ".json", Content: `{"architecture":"amd64","os":"linux"}`},
+		)
+		manifest = append(manifest, dockerArchiveManifest{Config: id + ".json", RepoTags: []string{ref}, Layers: []string{id + "/layer.tar"}})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, tarFile{Name: "manifest.json", Content: string(data)})
+	return ioutil.NopCloser(tarArchive(files...)), nil
+}
+
+// tarFile is a file or, if Link is set, a symlink in an archive created by tarArchive
+type tarFile struct {
+	Name    string
+	Content string
+	Link    string
+}
+
+func tarArchive(files ...tarFile) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, file := range files {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: file.Name, Mode: 0644, Size: int64(len(file.Content))}
+		if file.Link != "" {
+			header = &tar.Header{Typeflag: tar.TypeSymlink, Name: file.Name, Linkname: file.Link}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(file.Content)); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// readTar returns the regular files of a tar archive
+func readTar(data []byte) (map[string]string, error) {
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = string(content)
+	}
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Taken from GitLab Runner common module (can't use that directly because of insane dependencies)
@@ -224,12 +229,28 @@ type JobResponse struct {
 	Features      GitlabFeatures `json:"features"`
 }
 
+// Timeout returns how long the job is allowed to run as configured in GitLab. This is the job
+// timeout, further limited by the script step timeout. Zero means that there is no limit.
+func (j *JobResponse) Timeout() time.Duration {
+	timeout := j.RunnerInfo.Timeout
+	for _, step := range j.Steps {
+		if step.Name == StepNameScript && step.Timeout > 0 && (timeout <= 0 || step.Timeout < timeout) {
+			timeout = step.Timeout
+		}
+	}
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Duration(timeout) * time.Second
+}
+
 type JobVariable struct {
 	Key      string `json:"key"`
 	Value    string `json:"value"`
 	Public   bool   `json:"public"`
 	Internal bool   `json:"-"`
 	File     bool   `json:"file"`
+	Masked   bool   `json:"masked"`
 }
 
 type JobVariables []JobVariable
@@ -247,6 +268,16 @@ func (b JobVariables) PublicOrInternal() (variables JobVariables) {
 	return variables
 }
 
+// Masked returns the values of all variables which GitLab wants masked in the job log
+func (b JobVariables) Masked() (values []string) {
+	for _, variable := range b {
+		if variable.Masked {
+			values = append(values, variable.Value)
+		}
+	}
+	return values
+}
+
 func (b JobVariables) StringList() (variables []string) {
 	for _, variable := range b {
 		variables = append(variables, variable.String())
@@ -269,6 +300,29 @@ func (b JobVariables) Get(key string) string {
 	return ""
 }
 
+// Lookup returns the variable named key and whether it is set
+func (b JobVariables) Lookup(key string) (JobVariable, bool) {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i].Key == key {
+			return b[i], true
+		}
+	}
+	return JobVariable{}, false
+}
+
+// Bool parses the value of a variable as bool. Unset variables are false.
+func (b JobVariables) Bool(key string) (bool, error) {
+	value := b.Get(key)
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%v is not a Bool", key)
+	}
+	return enabled, nil
+}
+
 func (b JobVariables) ExpandValue(value string) string {
 	return os.Expand(value, b.Get)
 }
@@ -316,13 +370,46 @@ const (
 	NoneFailure         JobFailureReason = ""
 	ScriptFailure       JobFailureReason = "script_failure"
 	RunnerSystemFailure JobFailureReason = "runner_system_failure"
+	JobExecutionTimeout JobFailureReason = "job_execution_timeout"
 )
 
+type RegisterRunnerParameters struct {
+	Description    string `json:"description,omitempty"`
+	Tags           string `json:"tag_list,omitempty"`
+	RunUntagged    bool   `json:"run_untagged"`
+	Locked         bool   `json:"locked"`
+	MaximumTimeout int    `json:"maximum_timeout,omitempty"`
+}
+
+type RegisterRunnerRequest struct {
+	RegisterRunnerParameters
+	Info  VersionInfo `json:"info,omitempty"`
+	Token string      `json:"token,omitempty"`
+}
+
+type RegisterRunnerResponse struct {
+	ID    int    `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+type VerifyRunnerRequest struct {
+	Token string `json:"token,omitempty"`
+}
+
+type UnregisterRunnerRequest struct {
+	Token string `json:"token,omitempty"`
+}
+
 // GitlabRunnerClient is a minimal API client for the Gitlab Runner API
 type GitlabRunnerClient struct {
 	token       string
 	versionInfo VersionInfo
 	baseURL     string
+
+	// lastUpdate is the X-GitLab-Last-Update value of the last job request, it allows Workhorse to
+	// hold job requests until there is something new for this runner (long polling)
+	lastUpdateMu sync.Mutex
+	lastUpdate   string
 }
 
 // From https://stackoverflow.com/questions/8689425/remove-last-character-of-a-string
@@ -341,20 +428,123 @@ func NewGitlabRunnerClient(baseURL string, token string, versionInfo VersionInfo
 	}
 }
 
-func (c *GitlabRunnerClient) RequestJob() (*JobResponse, error) {
+// RegisterRunner exchanges a registration token for a new runner token. The client's own token is
+// not used, so this can be called on a client created without one.
+func (c *GitlabRunnerClient) RegisterRunner(registrationToken string, params RegisterRunnerParameters) (*RegisterRunnerResponse, error) {
+	bodyData := RegisterRunnerRequest{
+		RegisterRunnerParameters: params,
+		Info:                     c.versionInfo,
+		Token:                    registrationToken,
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(&bodyData); err != nil {
+		panic(err) // Is guaranteed by invariant
+	}
+	res, err := http.Post(fmt.Sprintf("%v/api/v4/runners", c.baseURL), "application/json; charset=utf-8", buf)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		var runner RegisterRunnerResponse
+		if err := json.NewDecoder(res.Body).Decode(&runner); err != nil {
+			return nil, fmt.Errorf("Failed to decode runner: %v", err)
+		}
+		if runner.Token == "" {
+			return nil, errors.New("Failed to register runner: GitLab returned no token")
+		}
+		return &runner, nil
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("Failed to register runner: GitLab denied access")
+	default:
+		return nil, fmt.Errorf("Failed to register runner: Got HTTP %v", res.StatusCode)
+	}
+}
+
+// VerifyRunner checks if the client's runner token is still known to GitLab.
+func (c *GitlabRunnerClient) VerifyRunner() (bool, error) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(&VerifyRunnerRequest{Token: c.token}); err != nil {
+		panic(err) // Is guaranteed by invariant
+	}
+	res, err := http.Post(fmt.Sprintf("%v/api/v4/runners/verify", c.baseURL), "application/json; charset=utf-8", buf)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Failed to verify runner: Got HTTP %v", res.StatusCode)
+	}
+}
+
+// UnregisterRunner deletes the runner identified by the client's token from GitLab. After this the
+// token is no longer usable.
+func (c *GitlabRunnerClient) UnregisterRunner() error {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(&UnregisterRunnerRequest{Token: c.token}); err != nil {
+		panic(err) // Is guaranteed by invariant
+	}
+	httpReq, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%v/api/v4/runners", c.baseURL), buf)
+	if err != nil {
+		panic(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusForbidden:
+		return fmt.Errorf("Failed to unregister runner: GitLab denied access")
+	default:
+		return fmt.Errorf("Failed to unregister runner: Got HTTP %v", res.StatusCode)
+	}
+}
+
+// RequestJob asks GitLab for a new job. If GitLab Workhorse has long polling enabled this blocks
+// until a job is available, the polling timeout has passed or ctx is canceled. Returns nil if there
+// is no job.
+func (c *GitlabRunnerClient) RequestJob(ctx context.Context) (*JobResponse, error) {
+	c.lastUpdateMu.Lock()
 	bodyData := JobRequest{
-		Info:  c.versionInfo,
-		Token: c.token,
+		Info:       c.versionInfo,
+		Token:      c.token,
+		LastUpdate: c.lastUpdate,
 	}
+	c.lastUpdateMu.Unlock()
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(&bodyData); err != nil {
 		panic(err) // Is guaranteed by invariant
 	}
-	res, err := http.Post(fmt.Sprintf("%v/api/v4/jobs/request", c.baseURL), "application/json; charset=utf-8", buf)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%v/api/v4/jobs/request", c.baseURL), buf)
+	if err != nil {
+		panic(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
+	if lastUpdate := res.Header.Get("X-GitLab-Last-Update"); lastUpdate != "" {
+		c.lastUpdateMu.Lock()
+		c.lastUpdate = lastUpdate
+		c.lastUpdateMu.Unlock()
+	}
 
 	switch res.StatusCode {
 	case http.StatusCreated:
@@ -409,9 +599,23 @@ func (c *GitlabRunnerClient) UpdateJob(id int, req UpdateJobRequest) (bool, erro
 
 }
 
-func (c *GitlabRunnerClient) PatchTrace(id int, token string, content []byte, startOffset int) error {
+// TraceRangeError is returned by PatchTrace if GitLab rejected a trace patch because its copy of
+// the trace has a different length than the patch's start offset.
+type TraceRangeError struct {
+	// RemoteOffset is the length of the trace stored by GitLab
+	RemoteOffset int
+}
+
+func (e *TraceRangeError) Error() string {
+	return fmt.Sprintf("Patch Trace request failed: GitLab has %d bytes of trace", e.RemoteOffset)
+}
+
+// PatchTrace appends content to the trace of a job. It returns the trace update interval suggested
+// by GitLab, which is shorter while somebody is watching the job, or zero if GitLab doesn't send
+// one.
+func (c *GitlabRunnerClient) PatchTrace(id int, token string, content []byte, startOffset int) (time.Duration, error) {
 	if len(content) == 0 {
-		return nil
+		return 0, nil
 	}
 	endOffset := startOffset + len(content)
 
@@ -425,13 +629,88 @@ func (c *GitlabRunnerClient) PatchTrace(id int, token string, content []byte, st
 	httpReq.Header.Set("Content-Type", "text/plain")
 	res, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	var interval time.Duration
+	if seconds, err := strconv.Atoi(res.Header.Get("X-GitLab-Trace-Update-Interval")); err == nil && seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// GitLab sends the range it has as "0-<length>"
+		var start, remoteOffset int
+		if _, err := fmt.Sscanf(res.Header.Get("Range"), "%d-%d", &start, &remoteOffset); err != nil {
+			return interval, fmt.Errorf("Patch Trace request failed: Got HTTP %d with invalid range %q", res.StatusCode, res.Header.Get("Range"))
+		}
+		return interval, &TraceRangeError{RemoteOffset: remoteOffset}
+	}
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("Patch Trace request failed: Got HTTP %d", res.StatusCode)
+		return interval, fmt.Errorf("Patch Trace request failed: Got HTTP %d", res.StatusCode)
+	}
+	return interval, nil
+}
+
+// ArtifactOptions describes an artifact uploaded with UploadArtifact
+type ArtifactOptions struct {
+	Type     string
+	Format   ArtifactFormat
+	ExpireIn string
+}
+
+// UploadArtifact uploads content as artifact of a job. name is the file name of the content as
+// stored by GitLab.
+func (c *GitlabRunnerClient) UploadArtifact(id int, token string, name string, content io.Reader, options ArtifactOptions) error {
+	body, bodyWriter := io.Pipe()
+	defer body.Close()
+	form := multipart.NewWriter(bodyWriter)
+	go func() {
+		fields := [][2]string{
+			{"artifact_type", options.Type},
+			{"artifact_format", string(options.Format)},
+			{"expire_in", options.ExpireIn},
+		}
+		for _, field := range fields {
+			if field[1] == "" {
+				continue
+			}
+			if err := form.WriteField(field[0], field[1]); err != nil {
+				bodyWriter.CloseWithError(err)
+				return
+			}
+		}
+		file, err := form.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(file, content)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	httpReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/api/v4/jobs/%v/artifacts", c.baseURL, id), body)
+	if err != nil {
+		panic(err)
+	}
+	httpReq.Header.Set("JOB-TOKEN", token)
+	httpReq.Header.Set("Content-Type", form.FormDataContentType())
+	res, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("Failed to upload artifact: %v", err)
 	}
-	//TODO(lorenz): Handle optional X-GitLab-Trace-Update-Interval header
+	defer res.Body.Close()
 	io.Copy(ioutil.Discard, res.Body)
-	return nil
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusForbidden:
+		return errors.New("Failed to upload artifact: GitLab denied access")
+	case http.StatusRequestEntityTooLarge:
+		return errors.New("Failed to upload artifact: Artifact is too large")
+	default:
+		return fmt.Errorf("Failed to upload artifact: Got HTTP %v", res.StatusCode)
+	}
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGitlab implements the parts of the GitLab Runner API used by GitlabRunnerClient
+type fakeGitlab struct {
+	registrationToken string
+
+	m       sync.Mutex
+	runners map[string]RegisterRunnerRequest
+	nextID  int
+
+	// queue contains jobs not yet picked up by a runner
+	queue       []*JobResponse
+	lastUpdate  string
+	jobRequests []JobRequest
+
+	traces map[int][]byte
+	// traceInterval is sent as X-GitLab-Trace-Update-Interval if set
+	traceInterval string
+
+	updates map[int][]UpdateJobRequest
+	// canceled contains jobs which have been canceled by a user
+	canceled map[int]bool
+	// finished receives the IDs of jobs for which a final state has been reported
+	finished chan int
+
+	artifacts map[int][]uploadedArtifact
+	// jobTokens contains the tokens of jobs, artifacts of other jobs are rejected
+	jobTokens map[int]string
+}
+
+func newFakeGitlab() (*fakeGitlab, *httptest.Server) {
+	f := &fakeGitlab{
+		registrationToken: "registration-token",
+		runners:           make(map[string]RegisterRunnerRequest),
+		traces:            make(map[int][]byte),
+		updates:           make(map[int][]UpdateJobRequest),
+		canceled:          make(map[int]bool),
+		finished:          make(chan int, 16),
+		artifacts:         make(map[int][]uploadedArtifact),
+		jobTokens:         make(map[int]string),
+	}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v4/runners":
+		var req RegisterRunnerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Token != f.registrationToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.nextID++
+		token := fmt.Sprintf("runner-token-%d", f.nextID)
+		f.runners[token] = req
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(RegisterRunnerResponse{ID: f.nextID, Token: token})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v4/runners/verify":
+		var req VerifyRunnerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.runners[req.Token]; !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/v4/runners":
+		var req UnregisterRunnerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.runners[req.Token]; !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		delete(f.runners, req.Token)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v4/jobs/request":
+		var req JobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.runners[req.Token]; !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.jobRequests = append(f.jobRequests, req)
+		w.Header().Set("X-GitLab-Last-Update", f.lastUpdate)
+		if len(f.queue) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		job := f.queue[0]
+		f.queue = f.queue[1:]
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/api/v4/jobs/"):
+		var id int
+		if _, err := fmt.Sscanf(r.URL.Path, "/api/v4/jobs/%d", &id); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req UpdateJobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.updates[id] = append(f.updates[id], req)
+		if f.canceled[id] {
+			w.Header().Set("Job-Status", "canceled")
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.State != Running {
+			f.finished <- id
+		}
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/api/v4/jobs/") && strings.HasSuffix(r.URL.Path, "/trace"):
+		var id, start, end int
+		if _, err := fmt.Sscanf(r.URL.Path, "/api/v4/jobs/%d/trace", &id); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.traceInterval != "" {
+			w.Header().Set("X-GitLab-Trace-Update-Interval", f.traceInterval)
+		}
+		if start != len(f.traces[id]) {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(f.traces[id])))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) != end-start+1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.traces[id] = append(f.traces[id], body...)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/v4/jobs/") && strings.HasSuffix(r.URL.Path, "/artifacts"):
+		var id int
+		if _, err := fmt.Sscanf(r.URL.Path, "/api/v4/jobs/%d/artifacts", &id); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if token, ok := f.jobTokens[id]; !ok || token != r.Header.Get("JOB-TOKEN") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		content, _ := ioutil.ReadAll(file)
+		f.artifacts[id] = append(f.artifacts[id], uploadedArtifact{
+			Name: header.Filename,
+			Options: ArtifactOptions{
+				Type:     r.FormValue("artifact_type"),
+				Format:   ArtifactFormat(r.FormValue("artifact_format")),
+				ExpireIn: r.FormValue("expire_in"),
+			},
+			Content: content,
+		})
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// addRunner registers a runner token without going through the registration API
+func (f *fakeGitlab) addRunner(token string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.runners[token] = RegisterRunnerRequest{}
+}
+
+// enqueue makes the job available to runners and bumps the last update value like GitLab does
+func (f *fakeGitlab) enqueue(job *JobResponse) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.queue = append(f.queue, job)
+	f.jobTokens[job.ID] = job.Token
+	f.lastUpdate = fmt.Sprintf("update-%d", len(f.jobRequests))
+}
+
+func TestRunnerRegistration(t *testing.T) {
+	f, srv := newFakeGitlab()
+	defer srv.Close()
+
+	c := NewGitlabRunnerClient(srv.URL+"/", "", versionInfo)
+	_, err := c.RegisterRunner("wrong-token", RegisterRunnerParameters{})
+	assert.Error(t, err, "Registering with an invalid registration token should fail")
+
+	params := RegisterRunnerParameters{
+		Description: "test runner",
+		Tags:        "docker,build",
+		RunUntagged: true,
+		Locked:      true,
+	}
+	runner, err := c.RegisterRunner(f.registrationToken, params)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, runner.ID)
+	assert.NotEmpty(t, runner.Token)
+	assert.Equal(t, params, f.runners[runner.Token].RegisterRunnerParameters, "Parameters should be sent to GitLab")
+	assert.Equal(t, versionInfo, f.runners[runner.Token].Info, "Version info should be sent to GitLab")
+
+	c = NewGitlabRunnerClient(srv.URL, runner.Token, versionInfo)
+	ok, err := c.VerifyRunner()
+	assert.NoError(t, err)
+	assert.True(t, ok, "Registered runner should verify")
+
+	assert.NoError(t, c.UnregisterRunner())
+	ok, err = c.VerifyRunner()
+	assert.NoError(t, err)
+	assert.False(t, ok, "Unregistered runner should not verify")
+	assert.Error(t, c.UnregisterRunner(), "Unregistering twice should fail")
+}
+
+func TestJobTimeout(t *testing.T) {
+	job := JobResponse{}
+	assert.Equal(t, time.Duration(0), job.Timeout(), "Jobs without timeout should be unbounded")
+	job.RunnerInfo.Timeout = 3600
+	assert.Equal(t, time.Hour, job.Timeout())
+	job.Steps = Steps{{Name: StepNameAfterScript, Timeout: 60}, {Name: StepNameScript, Timeout: 600}}
+	assert.Equal(t, 10*time.Minute, job.Timeout(), "A shorter script step timeout should take precedence")
+	job.RunnerInfo.Timeout = 0
+	assert.Equal(t, 10*time.Minute, job.Timeout(), "The script step timeout should apply without a job timeout")
+}
+
+func TestRequestJobLastUpdate(t *testing.T) {
+	f, srv := newFakeGitlab()
+	defer srv.Close()
+	f.addRunner("runner-token")
+	f.lastUpdate = "initial"
+
+	c := NewGitlabRunnerClient(srv.URL, "runner-token", versionInfo)
+	job, err := c.RequestJob(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, job, "There should be no job")
+
+	f.enqueue(&JobResponse{ID: 1, Token: "job-token"})
+	job, err = c.RequestJob(context.Background())
+	assert.NoError(t, err)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, 1, job.ID)
+	}
+	_, err = c.RequestJob(context.Background())
+	assert.NoError(t, err)
+
+	if assert.Len(t, f.jobRequests, 3) {
+		assert.Equal(t, "", f.jobRequests[0].LastUpdate, "The first request should not send a last update")
+		assert.Equal(t, "initial", f.jobRequests[1].LastUpdate, "The last update from GitLab should be sent back")
+		assert.Equal(t, "update-1", f.jobRequests[2].LastUpdate, "The last update should be tracked")
+	}
+
+	_, err = NewGitlabRunnerClient(srv.URL, "unknown-token", versionInfo).RequestJob(context.Background())
+	assert.Error(t, err, "Requesting a job with an unknown token should fail")
+}
+
+func TestPatchTrace(t *testing.T) {
+	f, srv := newFakeGitlab()
+	defer srv.Close()
+	c := NewGitlabRunnerClient(srv.URL, "runner-token", versionInfo)
+
+	interval, err := c.PatchTrace(1, "job-token", []byte("Hello "), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), interval, "Without header there should be no interval")
+
+	f.traceInterval = "3"
+	interval, err = c.PatchTrace(1, "job-token", []byte("World"), 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*time.Second, interval, "The interval suggested by GitLab should be returned")
+	assert.Equal(t, "Hello World", string(f.traces[1]))
+
+	_, err = c.PatchTrace(1, "job-token", []byte("!"), 3)
+	if rangeErr, ok := err.(*TraceRangeError); assert.True(t, ok, "A mismatching offset should return a TraceRangeError") {
+		assert.Equal(t, 11, rangeErr.RemoteOffset, "The length of the trace in GitLab should be returned")
+	}
+}
+
+func TestUploadArtifact(t *testing.T) {
+	f, srv := newFakeGitlab()
+	defer srv.Close()
+	f.enqueue(&JobResponse{ID: 7, Token: "job-token"})
+
+	c := NewGitlabRunnerClient(srv.URL, "runner-token", versionInfo)
+	options := ArtifactOptions{Type: "archive", Format: ArtifactFormatZip, ExpireIn: "1 week"}
+	err := c.UploadArtifact(7, "job-token", "artifacts.zip", strings.NewReader("content"), options)
+	assert.NoError(t, err)
+	if assert.Len(t, f.artifacts[7], 1) {
+		assert.Equal(t, uploadedArtifact{Name: "artifacts.zip", Options: options, Content: []byte("content")}, f.artifacts[7][0])
+	}
+
+	err = c.UploadArtifact(7, "wrong-token", "artifacts.zip", strings.NewReader("content"), options)
+	assert.Error(t, err, "Uploads rejected by GitLab should fail")
+	assert.Len(t, f.artifacts[7], 1)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// publicRepoURL removes the credentials GitLab puts into the repository URL of a job
+func publicRepoURL(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+// imageLabels returns the labels of a job's images. They describe where the image comes from with
+// the standard OCI annotations and can be extended by BUILD_LABELS, which contains one key=value
+// pair per line.
+func imageLabels(job *JobResponse, created time.Time) (map[string]string, error) {
+	labels := map[string]string{
+		"org.opencontainers.image.created":  created.UTC().Format(time.RFC3339),
+		"org.opencontainers.image.source":   publicRepoURL(job.GitInfo.RepoURL),
+		"org.opencontainers.image.revision": job.GitInfo.Sha,
+		"org.opencontainers.image.ref.name": job.Variables.Get("CI_COMMIT_REF_NAME"),
+		"org.opencontainers.image.url":      job.Variables.Get("CI_PROJECT_URL"),
+		"com.gitlab.ci.pipeline.id":         job.Variables.Get("CI_PIPELINE_ID"),
+		"com.gitlab.ci.job.id":              strconv.Itoa(job.ID),
+	}
+	for key, value := range labels {
+		if value == "" {
+			delete(labels, key)
+		}
+	}
+
+	for _, line := range strings.Split(job.Variables.Get("BUILD_LABELS"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		label, err := ParseVariable(line)
+		key := strings.TrimSpace(label.Key)
+		if err != nil || key == "" {
+			return nil, fmt.Errorf("BUILD_LABELS contains %q, which is not a key=value pair", line)
+		}
+		labels[key] = job.Variables.ExpandValue(strings.TrimSpace(label.Value))
+	}
+	return labels, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageLabels(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	labels, err := imageLabels(testJob(
+		JobVariable{Key: "CI_PROJECT_URL", Value: "https://gitlab.example.com/group/project"},
+		JobVariable{Key: "CI_PIPELINE_ID", Value: "1234"},
+		JobVariable{Key: "BUILD_LABELS", Value: "com.example.team=platform\n\n  com.example.version = $CI_PIPELINE_ID\norg.opencontainers.image.url=https://example.com\n"},
+	), created)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"org.opencontainers.image.created":  "2020-01-02T02:04:05Z",
+		"org.opencontainers.image.source":   "https://gitlab.example.com/group/project.git",
+		"org.opencontainers.image.revision": "0123456789abcdef",
+		"org.opencontainers.image.ref.name": "feature/foo",
+		"org.opencontainers.image.url":      "https://example.com",
+		"com.gitlab.ci.pipeline.id":         "1234",
+		"com.gitlab.ci.job.id":              "42",
+		"com.example.team":                  "platform",
+		"com.example.version":               "1234",
+	}, labels)
+
+	for _, invalid := range []string{"no-value", "=value"} {
+		_, err := imageLabels(testJob(JobVariable{Key: "BUILD_LABELS", Value: invalid}), created)
+		assert.Error(t, err, "Label %q should be rejected", invalid)
+	}
+}
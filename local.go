@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+type variableFlags []JobVariable
+
+func (v *variableFlags) String() string {
+	return fmt.Sprint(*v)
+}
+
+func (v *variableFlags) Set(text string) error {
+	variable, err := ParseVariable(text)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, variable)
+	return nil
+}
+
+// localGitlab implements GitlabAPI by writing the trace to out instead of sending it to GitLab.
+// Artifacts are saved to artifactsDir if it is set.
+type localGitlab struct {
+	out          io.Writer
+	artifactsDir string
+}
+
+func (l localGitlab) UpdateJob(id int, req UpdateJobRequest) (bool, error) {
+	return false, nil
+}
+
+func (l localGitlab) PatchTrace(id int, token string, content []byte, startOffset int) (time.Duration, error) {
+	_, err := l.out.Write(content)
+	// Nobody else is waiting for the trace, flush it as often as possible
+	return time.Second, err
+}
+
+func (l localGitlab) UploadArtifact(id int, token string, name string, content io.Reader, options ArtifactOptions) error {
+	if l.artifactsDir == "" {
+		return nil
+	}
+	dir := filepath.Join(l.artifactsDir, strconv.Itoa(id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, filepath.Base(name)))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// jobFiles returns the JSON files in path if it is a directory, otherwise just path
+func jobFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func loadJob(path string) (*JobResponse, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job JobResponse
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("Failed to decode job: %v", err)
+	}
+	return &job, nil
+}
+
+// execLocal runs jobs from JobResponse JSON files against the local Docker daemon without GitLab.
+// The trace is written to stdout.
+func execLocal() error {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	var variables variableFlags
+	fs.Var(&variables, "var", "Set or override a job variable (KEY=VALUE), can be repeated")
+	registry := fs.String("registry", "", "Registry to push to instead of CI_REGISTRY")
+	artifactsDir := fs.String("artifacts", "", "Directory artifacts are saved to, in a sub-directory per job")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v exec [flags] <job.json or directory>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(flag.Args()[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("No job given")
+	}
+	if *registry != "" && !registryHostFormat.MatchString(*registry) {
+		return fmt.Errorf("Registry %q is not a valid registry host", *registry)
+	}
+
+	docker, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("Failed to create Docker client: %v", err)
+	}
+	pullParent := true
+	config := RunnerConfig{
+		Name:     "local",
+		Registry: *registry,
+		Build:    BuildConfig{PullParent: &pullParent},
+	}
+	executor := NewJobExecutor(docker, localGitlab{out: os.Stdout, artifactsDir: *artifactsDir}, config)
+
+	var failed []string
+	for _, arg := range fs.Args() {
+		files, err := jobFiles(arg)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			job, err := loadJob(file)
+			if err != nil {
+				return fmt.Errorf("%v: %v", file, err)
+			}
+			job.Variables = append(job.Variables, variables...)
+			metaFmt.Printf("Running job %v from %v\n", job.ID, file)
+			state, reason := executor.Run(context.Background(), job)
+			fmt.Println()
+			if state != Success {
+				failFmt.Printf("Job %v from %v failed: %v\n", job.ID, file, reason)
+				failed = append(failed, file)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Jobs from %v failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
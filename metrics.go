@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	jobRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_runner_job_requests_total",
+		Help: "Job requests sent to GitLab by result (job, no_job or error)",
+	}, []string{"runner", "result"})
+	jobsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_runner_jobs_started_total",
+		Help: "Jobs started",
+	}, []string{"runner"})
+	jobsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_runner_jobs_finished_total",
+		Help: "Jobs finished by final state and failure reason",
+	}, []string{"runner", "state", "failure_reason"})
+	jobsRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "docker_runner_jobs_running",
+		Help: "Jobs currently running",
+	}, []string{"runner"})
+	buildDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "docker_runner_build_duration_seconds",
+		Help:    "Duration of image builds",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+	}, []string{"runner"})
+	pushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "docker_runner_push_duration_seconds",
+		Help:    "Duration of pushing all tags of an image",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"runner"})
+	pushRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_runner_push_retries_total",
+		Help: "Pushes of a tag which are retried after a registry error",
+	}, []string{"runner"})
+	tracePatchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_runner_trace_patch_errors_total",
+		Help: "Failed attempts to send a job trace to GitLab",
+	}, []string{"runner"})
+	dockerAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_runner_docker_api_errors_total",
+		Help: "Failed Docker API calls by operation",
+	}, []string{"operation"})
+)
+
+// dockerPinger is the part of the Docker client used for readiness checks
+type dockerPinger interface {
+	Ping(ctx context.Context) (types.Ping, error)
+}
+
+// serveHTTP serves metrics as well as liveness (/healthz) and readiness (/readyz) checks on addr
+func serveHTTP(addr string, docker *client.Client, shuttingDown *int32) {
+	glog.Infof("Serving metrics and health checks on %v", addr)
+	if err := http.ListenAndServe(addr, newHTTPHandler(docker, shuttingDown)); err != nil {
+		glog.Errorf("Failed to serve metrics and health checks: %v", err)
+	}
+}
+
+// newHTTPHandler returns the handler for metrics and health checks. Liveness only checks that the
+// process serves requests, so a short Docker daemon outage doesn't get the runner and all its
+// running jobs killed. Readiness also fails if the Docker daemon isn't reachable or once
+// shuttingDown is set.
+func newHTTPHandler(docker dockerPinger, shuttingDown *int32) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(shuttingDown) == 1 {
+			http.Error(w, "Runner is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		if _, err := docker.Ping(ctx); err != nil {
+			dockerAPIErrors.WithLabelValues("ping").Inc()
+			http.Error(w, "Docker daemon is not reachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePinger implements dockerPinger, it fails while err is set
+type fakePinger struct {
+	err error
+}
+
+func (f *fakePinger) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{}, f.err
+}
+
+func TestHTTPHandler(t *testing.T) {
+	docker := &fakePinger{}
+	var shuttingDown int32
+	srv := httptest.NewServer(newHTTPHandler(docker, &shuttingDown))
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	jobsStarted.WithLabelValues("test").Inc()
+	status, body := get("/metrics")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `docker_runner_jobs_started_total{runner="test"}`)
+
+	status, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+
+	docker.err = errors.New("connection refused")
+	status, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, status, "Liveness should not depend on the Docker daemon")
+	status, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, "connection refused")
+
+	docker.err = nil
+	atomic.StoreInt32(&shuttingDown, 1)
+	status, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status, "The runner should not be ready once shutting down")
+	assert.Contains(t, body, "shutting down")
+	status, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, status, "The runner should stay alive while draining jobs")
+}
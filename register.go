@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// runnerToken returns the runner token from GITLAB_RUNNER_TOKEN or, if that is unset, from the file
+// in GITLAB_RUNNER_TOKEN_FILE. file is the path the token was read from, empty if it came from the
+// environment.
+func runnerToken() (token string, file string, err error) {
+	if token := os.Getenv("GITLAB_RUNNER_TOKEN"); token != "" {
+		return token, "", nil
+	}
+	if path := os.Getenv("GITLAB_RUNNER_TOKEN_FILE"); path != "" {
+		token, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to read runner token: %v", err)
+		}
+		return strings.TrimSpace(string(token)), path, nil
+	}
+	return "", "", errors.New("Neither GITLAB_RUNNER_TOKEN nor GITLAB_RUNNER_TOKEN_FILE is set")
+}
+
+func envBool(name string) (bool, error) {
+	if os.Getenv(name) == "" {
+		return false, nil
+	}
+	val, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return false, fmt.Errorf("%v is not a Bool", name)
+	}
+	return val, nil
+}
+
+// register exchanges REGISTRATION_TOKEN for a runner token and persists it to
+// GITLAB_RUNNER_TOKEN_FILE (or prints it if that is unset).
+func register() error {
+	registrationToken := os.Getenv("REGISTRATION_TOKEN")
+	if registrationToken == "" {
+		return errors.New("REGISTRATION_TOKEN is not set")
+	}
+	params := RegisterRunnerParameters{
+		Description: os.Getenv("RUNNER_DESCRIPTION"),
+		Tags:        os.Getenv("RUNNER_TAG_LIST"),
+	}
+	var err error
+	if params.RunUntagged, err = envBool("RUNNER_RUN_UNTAGGED"); err != nil {
+		return err
+	}
+	if params.Locked, err = envBool("RUNNER_LOCKED"); err != nil {
+		return err
+	}
+	if params.Description == "" {
+		params.Description = versionInfo.Name
+	}
+
+	c := NewGitlabRunnerClient(os.Getenv("GITLAB_URL"), "", versionInfo)
+	runner, err := c.RegisterRunner(registrationToken, params)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Registered runner %v", runner.ID)
+
+	path := os.Getenv("GITLAB_RUNNER_TOKEN_FILE")
+	if path == "" {
+		fmt.Println(runner.Token)
+		return nil
+	}
+	if err := ioutil.WriteFile(path, []byte(runner.Token+"\n"), 0600); err != nil {
+		return fmt.Errorf("Failed to persist runner token: %v", err)
+	}
+	return nil
+}
+
+func verify() error {
+	token, _, err := runnerToken()
+	if err != nil {
+		return err
+	}
+	c := NewGitlabRunnerClient(os.Getenv("GITLAB_URL"), token, versionInfo)
+	ok, err := c.VerifyRunner()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Runner token is not valid")
+	}
+	glog.Infof("Runner token is valid")
+	return nil
+}
+
+// unregister deletes the runner from GitLab and removes the token file if the token was read from
+// it. A token file next to GITLAB_RUNNER_TOKEN may belong to another runner and is left alone.
+func unregister() error {
+	token, file, err := runnerToken()
+	if err != nil {
+		return err
+	}
+	c := NewGitlabRunnerClient(os.Getenv("GITLAB_URL"), token, versionInfo)
+	if err := c.UnregisterRunner(); err != nil {
+		return err
+	}
+	glog.Infof("Unregistered runner")
+	if file != "" {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove runner token: %v", err)
+		}
+	}
+	return nil
+}
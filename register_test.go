@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunnerToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-runner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/token"
+	assert.NoError(t, ioutil.WriteFile(path, []byte("file-token\n"), 0600))
+	defer os.Unsetenv("GITLAB_RUNNER_TOKEN")
+	defer os.Unsetenv("GITLAB_RUNNER_TOKEN_FILE")
+
+	os.Setenv("GITLAB_RUNNER_TOKEN_FILE", path)
+	token, file, err := runnerToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "file-token", token)
+	assert.Equal(t, path, file)
+
+	os.Setenv("GITLAB_RUNNER_TOKEN", "env-token")
+	token, file, err = runnerToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "env-token", token)
+	assert.Empty(t, file, "Tokens from the environment should not be attributed to the token file")
+
+	os.Unsetenv("GITLAB_RUNNER_TOKEN")
+	os.Unsetenv("GITLAB_RUNNER_TOKEN_FILE")
+	_, _, err = runnerToken()
+	assert.Error(t, err)
+}
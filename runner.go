@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/golang/glog"
+)
+
+// runner polls a single GitLab instance for jobs and runs them
+type runner struct {
+	docker *client.Client
+	stop   chan struct{}
+
+	m       sync.Mutex
+	config  RunnerConfig
+	client  *GitlabRunnerClient
+	running int
+}
+
+func newRunner(config RunnerConfig, docker *client.Client) *runner {
+	r := &runner{
+		docker: docker,
+		stop:   make(chan struct{}),
+	}
+	r.setConfig(config)
+	return r
+}
+
+// setConfig replaces the configuration of the runner. Jobs which are already running keep using
+// the old one. The GitLab client is only replaced if the URL or token changed, so long polling
+// state survives reloads.
+func (r *runner) setConfig(config RunnerConfig) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.client == nil || config.URL != r.config.URL || config.Token != r.config.Token {
+		r.client = NewGitlabRunnerClient(config.URL, config.Token, versionInfo)
+	}
+	r.config = config
+}
+
+// reserve takes one of the runner's job slots. It returns false if all of them are busy.
+func (r *runner) reserve() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.running >= *r.config.Concurrent {
+		return false
+	}
+	r.running++
+	return true
+}
+
+func (r *runner) release() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.running--
+}
+
+// pollInterval is the minimum time between two job requests of a runner. Long polled requests
+// which GitLab held for longer than this are repeated immediately.
+const pollInterval = 3 * time.Second
+
+// poll requests and starts jobs until the runner is stopped. Started jobs are added to jobs and get
+// failed once killCtx is canceled.
+func (r *runner) poll(killCtx context.Context, jobs *sync.WaitGroup) {
+	// stopCtx aborts long polled job requests once the runner is stopped
+	stopCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-stopCtx.Done():
+		}
+	}()
+
+	errBackoff := backoff{Min: 5 * time.Second, Max: 5 * time.Minute}
+	var wait time.Duration
+	for {
+		select {
+		case <-time.After(wait):
+		case <-r.stop:
+			return
+		}
+		// select picks randomly if both are ready, don't claim new jobs once the runner is stopped
+		if stopCtx.Err() != nil {
+			return
+		}
+		wait = pollInterval
+		// Only ask for a job if we can start it right away, otherwise leave it to other runners
+		if !r.reserve() {
+			continue
+		}
+		r.m.Lock()
+		config, c := r.config, r.client
+		r.m.Unlock()
+		requestStart := time.Now()
+		job, err := c.RequestJob(stopCtx)
+		if err != nil && stopCtx.Err() != nil {
+			r.release()
+			return
+		}
+		if err != nil {
+			jobRequests.WithLabelValues(config.Name, "error").Inc()
+			wait = errBackoff.Next()
+			glog.Warningf("Runner %v failed to request job, retrying in %v: %v", config.Name, wait, err)
+			r.release()
+			continue
+		}
+		errBackoff.Reset()
+		if job == nil {
+			jobRequests.WithLabelValues(config.Name, "no_job").Inc()
+			r.release()
+			wait -= time.Since(requestStart)
+			continue
+		}
+		jobRequests.WithLabelValues(config.Name, "job").Inc()
+		// There might be more jobs waiting, ask again right away
+		wait = 0
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			defer r.release()
+			jobsStarted.WithLabelValues(config.Name).Inc()
+			jobsRunning.WithLabelValues(config.Name).Inc()
+			defer jobsRunning.WithLabelValues(config.Name).Dec()
+			NewJobExecutor(r.docker, c, config).Run(killCtx, job)
+		}()
+	}
+}
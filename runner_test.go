@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunnerStop(t *testing.T) {
+	// Workhorse holds job requests until there is a job or its polling timeout has passed
+	requested := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices closed connections once the body has been read
+		io.Copy(ioutil.Discard, r.Body)
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	concurrent := 1
+	r := newRunner(RunnerConfig{Name: "test", URL: srv.URL, Token: "runner-token", Concurrent: &concurrent}, nil)
+	var jobs sync.WaitGroup
+	polled := make(chan struct{})
+	go func() {
+		r.poll(context.Background(), &jobs)
+		close(polled)
+	}()
+	<-requested
+	stopped := time.Now()
+	close(r.stop)
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stopping the runner should abort its pending job request")
+	}
+	assert.True(t, time.Since(stopped) < time.Second)
+	assert.Equal(t, 0, r.running, "The job slot of the aborted request should be released")
+}
+
+func TestRunnerSetConfig(t *testing.T) {
+	concurrent := 1
+	config := RunnerConfig{Name: "test", URL: "https://gitlab.example.com", Token: "runner-token", Concurrent: &concurrent}
+	r := newRunner(config, nil)
+	c := r.client
+
+	more := 2
+	config.Concurrent = &more
+	r.setConfig(config)
+	assert.Equal(t, 2, *r.config.Concurrent)
+	assert.True(t, c == r.client, "The client should be kept if GitLab and the token didn't change")
+
+	config.Token = "new-token"
+	r.setConfig(config)
+	assert.False(t, c == r.client, "A new client should be used for a new token")
+	assert.Equal(t, "new-token", r.client.token)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-units"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// savedImageFile is the name of the tarball containing a job's images if SAVE_IMAGE is set
+const savedImageFile = "image.tar"
+
+// Formats of SAVE_IMAGE
+const (
+	saveFormatDocker = "docker"
+	saveFormatOCI    = "oci"
+)
+
+// saveFormat returns the format the images of a job are saved in, empty if they aren't saved
+func saveFormat(job *JobResponse) (string, error) {
+	switch format := job.Variables.Get("SAVE_IMAGE"); format {
+	case "", saveFormatDocker, saveFormatOCI:
+		return format, nil
+	default:
+		return "", fmt.Errorf("SAVE_IMAGE is %q, but only %v and %v are supported", format, saveFormatDocker, saveFormatOCI)
+	}
+}
+
+// saveImage saves tags as savedImageFile in the job's files, either as archive like docker save
+// creates it or as OCI image layout
+func (e *JobExecutor) saveImage(ctx context.Context, job *JobResponse, tags []string, format string, files *outputFiles, out io.Writer, sections *traceSections) error {
+	sections.Start("save_image")
+	defer sections.End("save_image")
+	res, err := e.docker.ImageSave(ctx, tags)
+	if err != nil {
+		dockerAPIErrors.WithLabelValues("save").Inc()
+		return fmt.Errorf("Failed to save image: %v", err)
+	}
+	defer res.Close()
+	file, err := files.Create(savedImageFile)
+	if err != nil {
+		return fmt.Errorf("Failed to save image: %v", err)
+	}
+	defer file.Close()
+	if format == saveFormatOCI {
+		err = writeOCILayout(res, file)
+	} else {
+		_, err = io.Copy(file, res)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to save image: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to save image: %v", err)
+	}
+	metaFmt.Fprintf(out, "Saved %v as %v (%v)\n", strings.Join(tags, ", "), savedImageFile, units.HumanSize(float64(info.Size())))
+
+	for _, artifact := range job.Artifacts {
+		upload, err := newArtifactUpload(job, artifact, files)
+		if err != nil {
+			return err
+		}
+		if upload == nil {
+			continue
+		}
+		for _, name := range upload.files {
+			if name == savedImageFile {
+				return nil
+			}
+		}
+	}
+	fmt.Fprintf(out, "%v is not part of any artifact, add it to the paths of the job's artifacts to upload it\n", savedImageFile)
+	return nil
+}
+
+// dockerArchiveManifest is an entry of the manifest.json of archives created by docker save
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// writeOCILayout converts an archive created by docker save into a tarball of an OCI image layout.
+// Every tag of the archive gets an entry in the index, annotated with its tag and full name.
+func writeOCILayout(archive io.Reader, w io.Writer) error {
+	dir, err := ioutil.TempDir("", "docker-runner-oci")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The files of the archive are stored as blobs named after their digest, symlinks to
+	// identical layers are resolved once the whole archive has been read
+	blobs := make(map[string]v1.Descriptor)
+	links := make(map[string]string)
+	var manifests []dockerArchiveManifest
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read image archive: %v", err)
+		}
+		name := path.Clean(header.Name)
+		switch {
+		case header.Typeflag == tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), header.Linkname)
+		case header.Typeflag != tar.TypeReg:
+		case name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifests); err != nil {
+				return fmt.Errorf("Failed to parse image archive manifest: %v", err)
+			}
+		default:
+			blobs[name], err = storeBlob(dir, tr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(manifests) == 0 {
+		return errors.New("Image archive doesn't contain any images")
+	}
+	blob := func(name, mediaType string) (v1.Descriptor, error) {
+		name = path.Clean(name)
+		for i := 0; i < 16; i++ {
+			if desc, ok := blobs[name]; ok {
+				desc.MediaType = mediaType
+				return desc, nil
+			}
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return v1.Descriptor{}, fmt.Errorf("Image archive doesn't contain %v", name)
+	}
+
+	index := v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	var layout []v1.Descriptor
+	for _, entry := range manifests {
+		manifest := v1.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+		}
+		manifest.Config, err = blob(entry.Config, v1.MediaTypeImageConfig)
+		if err != nil {
+			return err
+		}
+		for _, layer := range entry.Layers {
+			desc, err := blob(layer, v1.MediaTypeImageLayer)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		desc, err := storeBlob(dir, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		desc.MediaType = v1.MediaTypeImageManifest
+		layout = append(layout, manifest.Config)
+		layout = append(layout, manifest.Layers...)
+		layout = append(layout, desc)
+
+		if len(entry.RepoTags) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, ref := range entry.RepoTags {
+			tagged := desc
+			tagged.Annotations = map[string]string{
+				v1.AnnotationRefName:       ref[strings.LastIndex(ref, ":")+1:],
+				"io.containerd.image.name": ref,
+			}
+			index.Manifests = append(index.Manifests, tagged)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}); err != nil {
+			return err
+		}
+	}
+	written := make(map[digest.Digest]bool)
+	for _, desc := range layout {
+		if written[desc.Digest] {
+			continue
+		}
+		written[desc.Digest] = true
+		if err := writeTarFile(tw, "blobs/sha256/"+desc.Digest.Encoded(), filepath.Join(dir, desc.Digest.Encoded())); err != nil {
+			return err
+		}
+	}
+	for _, file := range []struct {
+		name  string
+		value interface{}
+	}{
+		{v1.ImageLayoutFile, v1.ImageLayout{Version: v1.ImageLayoutVersion}},
+		{"index.json", index},
+	} {
+		data, err := json.Marshal(file.value)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: file.name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// storeBlob copies r into dir, named after its digest
+func storeBlob(dir string, r io.Reader) (v1.Descriptor, error) {
+	file, err := ioutil.TempFile(dir, "blob")
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer file.Close()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(file, digester.Hash()), r)
+	if err != nil {
+		os.Remove(file.Name())
+		return v1.Descriptor{}, fmt.Errorf("Failed to read image archive: %v", err)
+	}
+	desc := v1.Descriptor{Digest: digester.Digest(), Size: size}
+	if err := os.Rename(file.Name(), filepath.Join(dir, desc.Digest.Encoded())); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// writeTarFile adds the file at src to tw as name
+func writeTarFile(tw *tar.Writer, name, src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: info.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteOCILayout(t *testing.T) {
+	archive := tarArchive(
+		tarFile{Name: "base/layer.tar", Content: "base"},
+		tarFile{Name: "app/layer.tar", Content: "app"},
+		tarFile{Name: "tool/layer.tar", Link: "../base/layer.tar"},
+		tarFile{Name: "app.json", Content: "app config"},
+		tarFile{Name: "tool.json", Content: "tool config"},
+		tarFile{Name: "manifest.json", Content: `[
+			{"Config": "app.json", "RepoTags": ["registry.example.com:5000/app:1.0", "registry.example.com:5000/app:latest"], "Layers": ["base/layer.tar", "app/layer.tar"]},
+			{"Config": "tool.json", "RepoTags": null, "Layers": ["tool/layer.tar"]}
+		]`},
+		tarFile{Name: "repositories", Content: "{}"},
+	)
+	var out bytes.Buffer
+	assert.NoError(t, writeOCILayout(archive, &out))
+	files, err := readTar(out.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.JSONEq(t, `{"imageLayoutVersion": "1.0.0"}`, files["oci-layout"])
+	for _, content := range []string{"base", "app", "app config", "tool config"} {
+		assert.Equal(t, content, files["blobs/sha256/"+digest.FromString(content).Encoded()])
+	}
+	assert.Len(t, files, 2+4+2, "Blobs should only be stored once and files not referenced by the manifest dropped")
+
+	var index v1.Index
+	if !assert.NoError(t, json.Unmarshal([]byte(files["index.json"]), &index)) || !assert.Len(t, index.Manifests, 3) {
+		return
+	}
+	assert.Equal(t, map[string]string{
+		v1.AnnotationRefName:       "1.0",
+		"io.containerd.image.name": "registry.example.com:5000/app:1.0",
+	}, index.Manifests[0].Annotations)
+	assert.Equal(t, "latest", index.Manifests[1].Annotations[v1.AnnotationRefName])
+	assert.Equal(t, index.Manifests[0].Digest, index.Manifests[1].Digest)
+	assert.Empty(t, index.Manifests[2].Annotations, "Untagged images should be in the index without annotations")
+
+	var manifest v1.Manifest
+	assert.NoError(t, json.Unmarshal([]byte(files["blobs/sha256/"+index.Manifests[2].Digest.Encoded()]), &manifest))
+	assert.Equal(t, v1.MediaTypeImageManifest, index.Manifests[2].MediaType)
+	assert.Equal(t, v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.FromString("tool config"), Size: 11}, manifest.Config)
+	assert.Equal(t, []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromString("base"), Size: 4}}, manifest.Layers, "Symlinked layers should be resolved")
+
+	err = writeOCILayout(tarArchive(tarFile{Name: "manifest.json", Content: `[{"Config": "missing.json"}]`}), &out)
+	assert.EqualError(t, err, "Image archive doesn't contain missing.json")
+	err = writeOCILayout(tarArchive(tarFile{Name: "repositories", Content: "{}"}), &out)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// traceSections writes GitLab section markers which make parts of a trace collapsible and show how
+// long they took. Nothing is written if the job's GitLab doesn't support sections.
+type traceSections struct {
+	out     io.Writer
+	enabled bool
+	now     func() time.Time
+	open    []string
+}
+
+func newTraceSections(out io.Writer, enabled bool) *traceSections {
+	return &traceSections{out: out, enabled: enabled, now: time.Now}
+}
+
+// Start opens a section. The line written after it is used as the header of the section.
+func (s *traceSections) Start(name string) {
+	if !s.enabled {
+		return
+	}
+	s.open = append(s.open, name)
+	fmt.Fprintf(s.out, "section_start:%d:%v\r\033[0K", s.now().Unix(), name)
+}
+
+// End closes a section and all sections which have been opened inside of it. Sections which are
+// not open are ignored.
+func (s *traceSections) End(name string) {
+	for i := len(s.open) - 1; i >= 0; i-- {
+		if s.open[i] != name {
+			continue
+		}
+		for j := len(s.open) - 1; j >= i; j-- {
+			fmt.Fprintf(s.out, "section_end:%d:%v\r\033[0K", s.now().Unix(), s.open[j])
+		}
+		s.open = s.open[:i]
+		return
+	}
+}
+
+// EndAll closes all open sections
+func (s *traceSections) EndAll() {
+	if len(s.open) > 0 {
+		s.End(s.open[0])
+	}
+}
+
+var buildStepFormat = regexp.MustCompile(`^Step ([0-9]+)/[0-9]+ :`)
+
+// buildSections puts every Dockerfile step and every base image pull of a build into its own
+// section
+type buildSections struct {
+	*traceSections
+	step  string
+	pulls int
+	pull  string
+	// pullDone is set after the summary of a pull, which is the last line of its section
+	pullDone bool
+}
+
+func (b *buildSections) message(msg jsonmessage.JSONMessage) {
+	if b.pullDone {
+		b.End(b.pull)
+		b.pull, b.pullDone = "", false
+	}
+	if match := buildStepFormat.FindStringSubmatch(msg.Stream); match != nil {
+		if b.step != "" {
+			b.End(b.step)
+		}
+		b.pull, b.pullDone = "", false
+		b.step = "build_step_" + match[1]
+		b.Start(b.step)
+		return
+	}
+	switch {
+	case b.pull == "" && strings.HasPrefix(msg.Status, "Pulling from "):
+		b.pulls++
+		b.pull = fmt.Sprintf("pull_base_image_%d", b.pulls)
+		b.Start(b.pull)
+	case b.pull != "" && strings.HasPrefix(msg.Status, "Status: "):
+		b.pullDone = true
+	}
+}
+
+// displayJSONMessages works like jsonmessage.DisplayJSONMessagesStream for output which isn't a
+// terminal, but passes every message to before prior to displaying it.
+func displayJSONMessages(in io.Reader, out io.Writer, before func(jsonmessage.JSONMessage), aux func(jsonmessage.JSONMessage)) error {
+	dec := json.NewDecoder(in)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Aux != nil {
+			if aux != nil {
+				aux(msg)
+			}
+			continue
+		}
+		if before != nil {
+			before(msg)
+		}
+		if err := msg.Display(out, false); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceSections(t *testing.T) {
+	var out bytes.Buffer
+	sections := newTraceSections(&out, true)
+	sections.now = func() time.Time { return time.Unix(1000, 0) }
+	steps := &buildSections{traceSections: sections}
+
+	err := displayJSONMessages(jsonStream(
+		jsonmessage.JSONMessage{Stream: "Step 1/2 : FROM alpine\n"},
+		jsonmessage.JSONMessage{Status: "Pulling from library/alpine", ID: "latest"},
+		jsonmessage.JSONMessage{Status: "Pull complete", ID: "abc"},
+		jsonmessage.JSONMessage{Status: "Status: Downloaded newer image for alpine:latest"},
+		jsonmessage.JSONMessage{Stream: " ---> 123\n"},
+		jsonmessage.JSONMessage{Stream: "Step 2/2 : RUN true\n"},
+		auxMessage(map[string]string{"ID": "sha256:123"}),
+		jsonmessage.JSONMessage{Stream: " ---> 456\n"},
+	), &out, steps.message, nil)
+	assert.NoError(t, err)
+	sections.EndAll()
+
+	assert.Equal(t, "section_start:1000:build_step_1\r\033[0KStep 1/2 : FROM alpine\n"+
+		"section_start:1000:pull_base_image_1\r\033[0Klatest: Pulling from library/alpine\n"+
+		"abc: Pull complete\n"+
+		"Status: Downloaded newer image for alpine:latest\n"+
+		"section_end:1000:pull_base_image_1\r\033[0K ---> 123\n"+
+		"section_end:1000:build_step_1\r\033[0Ksection_start:1000:build_step_2\r\033[0KStep 2/2 : RUN true\n"+
+		" ---> 456\n"+
+		"section_end:1000:build_step_2\r\033[0K", out.String())
+
+	out.Reset()
+	disabled := newTraceSections(&out, false)
+	disabled.Start("resolve_registry")
+	disabled.EndAll()
+	assert.Empty(t, out.String(), "No markers should be written if sections are not supported")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// semverFormat matches semantic versions with an optional v prefix
+var semverFormat = regexp.MustCompile(`^v?((0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*))(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// validTag checks if tag is allowed as Docker image tag
+func validTag(tag string) bool {
+	return tag != "" && len(tag) <= 128 && !tagInvalidChars.MatchString(tag) && tag[0] != '.' && tag[0] != '-'
+}
+
+// imageName returns the path of a job's image in the registry, without registry and tag. It is
+// the lower case project path unless IMAGE_NAME is set.
+func imageName(job *JobResponse) (string, error) {
+	template := job.Variables.Get("IMAGE_NAME")
+	if template == "" {
+		return strings.ToLower(job.Variables.Get("CI_PROJECT_PATH")), nil
+	}
+	name := job.Variables.ExpandValue(template)
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || registryInvalidChars.MatchString(component) {
+			return "", fmt.Errorf("IMAGE_NAME %q is not a valid image name. Only lower case alphanumeric characters, '.', '-' and '/' are supported.", name)
+		}
+	}
+	return name, nil
+}
+
+// semverTags expands a version into the tags it is published under, v1.2.3 becomes 1.2.3, 1.2 and
+// 1. 0.x versions don't get a major tag as their minor versions aren't compatible, pre-releases
+// only get their full version. Build metadata is dropped as + is not allowed in tags. Other refs
+// don't get any tags.
+func semverTags(version string) []string {
+	match := semverFormat.FindStringSubmatch(version)
+	if match == nil {
+		return nil
+	}
+	if match[5] != "" {
+		return []string{match[1] + match[5]}
+	}
+	if match[2] == "0" {
+		return []string{match[1], match[2] + "." + match[3]}
+	}
+	return []string{match[1], match[2] + "." + match[3], match[2]}
+}
+
+// imageTags returns the tags the image of a job is pushed under. The first one is always the commit
+// SHA, which identifies the image for SKIP_EXISTING.
+func imageTags(job *JobResponse) ([]string, error) {
+	if job.GitInfo.Sha == "" {
+		return nil, errors.New("Job has no commit SHA to tag its image with")
+	}
+	tags := []string{tagInvalidChars.ReplaceAllString(job.Variables.Get("CI_COMMIT_REF_NAME"), "")}
+
+	semver, err := job.Variables.Bool("SEMVER_TAGS")
+	if err != nil {
+		return nil, err
+	}
+	if semver && job.GitInfo.RefType == RefTypeTag {
+		tags = append(tags, semverTags(job.Variables.Get("CI_COMMIT_REF_NAME"))...)
+	}
+
+	latest, err := job.Variables.Bool("LATEST_TAG")
+	if err != nil {
+		return nil, err
+	}
+	defaultBranch := job.Variables.Get("CI_DEFAULT_BRANCH")
+	if latest && job.GitInfo.RefType == RefTypeBranch && defaultBranch != "" && job.Variables.Get("CI_COMMIT_REF_NAME") == defaultBranch {
+		tags = append(tags, "latest")
+	}
+
+	for _, tag := range strings.Split(job.Variables.ExpandValue(job.Variables.Get("EXTRA_TAGS")), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !validTag(tag) {
+			return nil, fmt.Errorf("EXTRA_TAGS contains the invalid tag %q. Tags may contain up to 128 alphanumeric characters, '_', '.' and '-' and must not start with '.' or '-'.", tag)
+		}
+		tags = append(tags, tag)
+	}
+
+	unique := []string{job.GitInfo.Sha}
+	seen := map[string]bool{job.GitInfo.Sha: true}
+	for _, tag := range tags {
+		if tag != "" && !seen[tag] {
+			unique = append(unique, tag)
+			seen[tag] = true
+		}
+	}
+	return unique, nil
+}
+
+// buildTarget is a stage of the Dockerfile which is built as its own image
+type buildTarget struct {
+	// name is the stage, empty for the last one
+	name string
+	// suffix is appended to the image name
+	suffix string
+}
+
+// buildTargets returns the targets built by a job. BUILD_TARGET selects the stage built as the
+// job's image, BUILD_TARGETS lists stages which are pushed as sub-images named after them.
+func buildTargets(job *JobResponse) ([]buildTarget, error) {
+	target := job.Variables.Get("BUILD_TARGET")
+	list := job.Variables.Get("BUILD_TARGETS")
+	if target != "" && list != "" {
+		return nil, errors.New("BUILD_TARGET and BUILD_TARGETS can't be used together")
+	}
+	if list == "" {
+		return []buildTarget{{name: target}}, nil
+	}
+	var targets []buildTarget
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		suffix := strings.ToLower(name)
+		if registryInvalidChars.MatchString(suffix) {
+			return nil, fmt.Errorf("BUILD_TARGETS contains %q, which can't be used in an image name. Only alphanumeric characters, '.' and '-' are supported.", name)
+		}
+		if seen[suffix] {
+			continue
+		}
+		seen[suffix] = true
+		targets = append(targets, buildTarget{name: name, suffix: "/" + suffix})
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("BUILD_TARGETS doesn't contain any targets")
+	}
+	return targets, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSemverTags(t *testing.T) {
+	assert.Equal(t, []string{"1.2.3", "1.2", "1"}, semverTags("v1.2.3"))
+	assert.Equal(t, []string{"10.0.20", "10.0", "10"}, semverTags("10.0.20"))
+	assert.Equal(t, []string{"1.2.3", "1.2", "1"}, semverTags("v1.2.3+build.5"), "Build metadata should be dropped")
+	assert.Equal(t, []string{"0.3.1", "0.3"}, semverTags("v0.3.1"), "0.x versions should not get a major tag")
+	assert.Equal(t, []string{"1.2.3-rc.1"}, semverTags("v1.2.3-rc.1"), "Pre-releases should only get their full version")
+	assert.Empty(t, semverTags("v1.2"))
+	assert.Empty(t, semverTags("release-1.2.3"))
+	assert.Empty(t, semverTags("v01.2.3"))
+}
+
+func TestImageTags(t *testing.T) {
+	tags, err := imageTags(testJob())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "featurefoo"}, tags)
+
+	job := testJob(
+		JobVariable{Key: "CI_COMMIT_REF_NAME", Value: "v1.2.3"},
+		JobVariable{Key: "SEMVER_TAGS", Value: "true"},
+	)
+	tags, err = imageTags(job)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "v1.2.3"}, tags, "Semver tags should only be added for tag pipelines")
+	job.GitInfo.RefType = RefTypeTag
+	tags, err = imageTags(job)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "v1.2.3", "1.2.3", "1.2", "1"}, tags)
+
+	job = testJob(
+		JobVariable{Key: "CI_COMMIT_REF_NAME", Value: "main"},
+		JobVariable{Key: "CI_DEFAULT_BRANCH", Value: "main"},
+	)
+	tags, err = imageTags(job)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "main"}, tags, "latest should only be added if enabled")
+	job.Variables = append(job.Variables, JobVariable{Key: "LATEST_TAG", Value: "true"})
+	tags, err = imageTags(job)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "main", "latest"}, tags)
+	tags, err = imageTags(testJob(JobVariable{Key: "LATEST_TAG", Value: "true"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "featurefoo"}, tags, "latest should only be added for the default branch")
+
+	tags, err = imageTags(testJob(
+		JobVariable{Key: "CI_PIPELINE_ID", Value: "1234"},
+		JobVariable{Key: "EXTRA_TAGS", Value: "nightly, pipeline-$CI_PIPELINE_ID,,featurefoo"},
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "featurefoo", "nightly", "pipeline-1234"}, tags)
+
+	for _, extra := range []string{"feature/foo", "-foo", ".foo", "$CI_COMMIT_REF_NAME", strings.Repeat("a", 129)} {
+		_, err = imageTags(testJob(JobVariable{Key: "EXTRA_TAGS", Value: extra}))
+		assert.Error(t, err, "Extra tag %q should be rejected", extra)
+	}
+	_, err = imageTags(testJob(JobVariable{Key: "SEMVER_TAGS", Value: "yes please"}))
+	assert.Error(t, err)
+
+	job = testJob(JobVariable{Key: "EXTRA_TAGS", Value: "0123456789abcdef"})
+	job.GitInfo.Sha = ""
+	_, err = imageTags(job)
+	assert.Error(t, err, "Jobs without a commit SHA should be rejected")
+
+	job = testJob(
+		JobVariable{Key: "CI_COMMIT_REF_NAME", Value: "0123456789abcdef"},
+		JobVariable{Key: "EXTRA_TAGS", Value: "nightly"},
+	)
+	tags, err = imageTags(job)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "nightly"}, tags, "The SHA should stay first if other tags are the same")
+}
+
+func TestImageName(t *testing.T) {
+	name, err := imageName(testJob())
+	assert.NoError(t, err)
+	assert.Equal(t, "group/project", name)
+
+	name, err = imageName(testJob(
+		JobVariable{Key: "CI_PROJECT_NAMESPACE", Value: "group"},
+		JobVariable{Key: "IMAGE_NAME", Value: "$CI_PROJECT_NAMESPACE/images/app"},
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, "group/images/app", name)
+
+	for _, template := range []string{"Group/app", "group//app", "/app", "group/$UNSET", "group/app:tag"} {
+		_, err = imageName(testJob(JobVariable{Key: "IMAGE_NAME", Value: template}))
+		assert.Error(t, err, "Image name %q should be rejected", template)
+	}
+}
+
+func TestBuildTargets(t *testing.T) {
+	targets, err := buildTargets(testJob())
+	assert.NoError(t, err)
+	assert.Equal(t, []buildTarget{{}}, targets, "The last stage should be built by default")
+
+	targets, err = buildTargets(testJob(JobVariable{Key: "BUILD_TARGET", Value: "release"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []buildTarget{{name: "release"}}, targets)
+
+	targets, err = buildTargets(testJob(JobVariable{Key: "BUILD_TARGETS", Value: "app, Migrations,app"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []buildTarget{{name: "app", suffix: "/app"}, {name: "Migrations", suffix: "/migrations"}}, targets)
+
+	invalid := map[string][]JobVariable{
+		"both":         {{Key: "BUILD_TARGET", Value: "a"}, {Key: "BUILD_TARGETS", Value: "b"}},
+		"invalid name": {{Key: "BUILD_TARGETS", Value: "app,db_migrations"}},
+		"empty list":   {{Key: "BUILD_TARGETS", Value: " , "}},
+	}
+	for name, variables := range invalid {
+		_, err := buildTargets(testJob(variables...))
+		assert.Error(t, err, "Targets with %v should be rejected", name)
+	}
+}
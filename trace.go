@@ -5,7 +5,13 @@ import (
 	"fmt"
 	"hash"
 	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sort"
 	"sync"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
 )
 
 func NewTrace() *Trace {
@@ -14,30 +20,172 @@ func NewTrace() *Trace {
 	}
 }
 
+// Trace buffers the output of a job until it has been sent to GitLab. Data GitLab already has is
+// moved to a temporary file, so only the unsent tail is kept in memory.
 type Trace struct {
+	// b contains the trace after the spilled part
 	b        bytes.Buffer
 	checksum hash.Hash32
 	offset   int
 	m        sync.Mutex
 	readMu   sync.Mutex
 	lastRead int
+
+	// masked contains the values replaced by maskedReplacement, longest first
+	masked [][]byte
+	// maskedStart marks the first bytes of all masked values
+	maskedStart [256]bool
+	// pending is written data which hasn't been masked yet because it might be the start of a
+	// masked value
+	pending []byte
+
+	// spill contains the first spilled bytes of the trace. It is created on the first commit.
+	spill   *os.File
+	spilled int
+	// spillFailed is set if the file could not be written, everything is kept in memory then
+	spillFailed bool
+
+	// limit is the maximum length of the trace, zero means unlimited
+	limit     int
+	truncated bool
+}
+
+const maskedReplacement = "[MASKED]"
+
+// SetLimit sets the maximum length of the trace in bytes. Output beyond it is replaced by a notice.
+func (t *Trace) SetLimit(limit int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.limit = limit
+}
+
+// Len returns the length of the trace
+func (t *Trace) Len() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.len()
+}
+
+func (t *Trace) len() int {
+	return t.spilled + t.b.Len()
+}
+
+// Close removes the temporary file of the trace
+func (t *Trace) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.spill == nil {
+		return nil
+	}
+	t.spill.Close()
+	err := os.Remove(t.spill.Name())
+	t.spill = nil
+	return err
+}
+
+// SetMasked sets values which are replaced by [MASKED] before they become part of the trace. It
+// should be called before the first write.
+func (t *Trace) SetMasked(values []string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.masked = nil
+	t.maskedStart = [256]bool{}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		t.masked = append(t.masked, []byte(value))
+		t.maskedStart[value[0]] = true
+	}
+	sort.Slice(t.masked, func(i, j int) bool { return len(t.masked[i]) > len(t.masked[j]) })
 }
 
 func (t *Trace) Write(p []byte) (n int, err error) {
 	t.m.Lock()
 	defer t.m.Unlock()
+	t.pending = append(t.pending, p...)
+	t.maskPending(false)
+	return len(p), nil
+}
+
+// Flush makes all written data available to NextChunk, including a tail held back because it
+// might have been the start of a masked value.
+func (t *Trace) Flush() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.maskPending(true)
+}
+
+// maskPending moves pending data to the trace, replacing masked values. Unless all is set, data
+// which might be the start of a masked value continued by the next write is kept pending.
+func (t *Trace) maskPending(all bool) {
+	data := t.pending
+	out := make([]byte, 0, len(data))
+	i := 0
+scan:
+	for i < len(data) {
+		if !t.maskedStart[data[i]] {
+			out = append(out, data[i])
+			i++
+			continue
+		}
+		for _, value := range t.masked {
+			if bytes.HasPrefix(data[i:], value) {
+				out = append(out, maskedReplacement...)
+				i += len(value)
+				continue scan
+			}
+			// Longer values take precedence, so wait for more data before masking a shorter one
+			if !all && len(data)-i < len(value) && bytes.HasPrefix(value, data[i:]) {
+				break scan
+			}
+		}
+		out = append(out, data[i])
+		i++
+	}
+	t.pending = append([]byte(nil), data[i:]...)
+	t.append(out)
+}
+
+// append adds masked data to the trace, enforcing the limit
+func (t *Trace) append(p []byte) {
+	if t.truncated {
+		return
+	}
+	if t.limit > 0 && t.len()+len(p) > t.limit {
+		// Cut after the last complete line, or at least not within a character
+		n := t.limit - t.len()
+		if i := bytes.LastIndexByte(p[:n], '\n'); i >= 0 {
+			n = i + 1
+		}
+		for n > 0 && !utf8.RuneStart(p[n]) {
+			n--
+		}
+		p = append(p[:n:n], fmt.Sprintf("\nJob's log exceeded limit of %v bytes.\nJob execution will continue but no more output will be collected.\n", t.limit)...)
+		t.truncated = true
+	}
 	t.checksum.Write(p)
-	return t.b.Write(p)
+	t.b.Write(p)
 }
 
 func (t *Trace) NextChunk() ([]byte, int) {
 	t.readMu.Lock()
 	t.m.Lock()
 	defer t.m.Unlock()
-	outAlias := t.b.Bytes()[t.offset:]
-	t.lastRead = len(outAlias)
-	out := make([]byte, len(outAlias))
-	copy(out, outAlias)
+	var out []byte
+	if t.offset < t.spilled {
+		// GitLab wants data again which has already been moved to the file
+		out = make([]byte, t.spilled-t.offset)
+		if _, err := t.spill.ReadAt(out, int64(t.offset)); err != nil {
+			glog.Errorf("Failed to read trace from %v: %v", t.spill.Name(), err)
+			t.lastRead = 0
+			return nil, t.offset
+		}
+		out = append(out, t.b.Bytes()...)
+	} else {
+		out = append([]byte(nil), t.b.Bytes()[t.offset-t.spilled:]...)
+	}
+	t.lastRead = len(out)
 	return out, t.offset
 }
 
@@ -45,9 +193,34 @@ func (t *Trace) CommitChunk() {
 	t.m.Lock()
 	defer t.m.Unlock()
 	t.offset += t.lastRead
+	t.spillCommitted()
 	t.readMu.Unlock()
 }
 
+// spillCommitted moves the data GitLab has received from memory to the file
+func (t *Trace) spillCommitted() {
+	n := t.offset - t.spilled
+	if n <= 0 || t.spillFailed {
+		return
+	}
+	if t.spill == nil {
+		f, err := ioutil.TempFile("", "docker-runner-trace")
+		if err != nil {
+			glog.Warningf("Failed to create trace file, keeping the trace in memory: %v", err)
+			t.spillFailed = true
+			return
+		}
+		t.spill = f
+	}
+	if _, err := t.spill.WriteAt(t.b.Bytes()[:n], int64(t.spilled)); err != nil {
+		glog.Warningf("Failed to write trace file, keeping the trace in memory: %v", err)
+		t.spillFailed = true
+		return
+	}
+	t.b.Next(n)
+	t.spilled += n
+}
+
 func (t *Trace) AbortChunk() {
 	t.m.Lock()
 	defer t.m.Unlock()
@@ -55,6 +228,22 @@ func (t *Trace) AbortChunk() {
 	t.readMu.Unlock()
 }
 
+// Resync ends the current read like AbortChunk, but continues from offset instead of the previous
+// position. This is used if the receiver has a different amount of data than expected.
+func (t *Trace) Resync(offset int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > t.len() {
+		offset = t.len()
+	}
+	t.offset = offset
+	t.lastRead = 0
+	t.readMu.Unlock()
+}
+
 func (t *Trace) Offset() int {
 	t.m.Lock()
 	defer t.m.Unlock()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -29,3 +30,115 @@ func TestTrace(t *testing.T) {
 	assert.Equal(t, off, len(testVal1), "Offset should be the first chunk")
 	tr.CommitChunk()
 }
+
+func TestTraceResync(t *testing.T) {
+	tr := NewTrace()
+	tr.Write([]byte("Hello World"))
+	chunk, off := tr.NextChunk()
+	assert.Equal(t, "Hello World", string(chunk))
+	assert.Equal(t, 0, off)
+	tr.Resync(6)
+	chunk, off = tr.NextChunk()
+	assert.Equal(t, "World", string(chunk), "NextChunk should continue from the resynced offset")
+	assert.Equal(t, 6, off)
+	tr.Resync(100)
+	chunk, off = tr.NextChunk()
+	assert.Len(t, chunk, 0, "Resync should not go beyond the end of the trace")
+	assert.Equal(t, 11, off)
+	tr.CommitChunk()
+}
+
+func TestTraceMasking(t *testing.T) {
+	tr := NewTrace()
+	tr.SetMasked([]string{"secret", "secret-password", ""})
+	tr.Write([]byte("user secret-password "))
+	tr.Write([]byte("token sec"))
+	chunk, _ := tr.NextChunk()
+	assert.Equal(t, "user [MASKED] token ", string(chunk), "A possible start of a masked value should be held back")
+	tr.CommitChunk()
+	tr.Write([]byte("ret second se"))
+	tr.Write([]byte("cret-pass"))
+	tr.Write([]byte("word"))
+	chunk, _ = tr.NextChunk()
+	assert.Equal(t, "[MASKED] second [MASKED]", string(chunk), "Values spanning writes should be masked")
+	tr.CommitChunk()
+	tr.Write([]byte(" end sec"))
+	tr.Flush()
+	chunk, _ = tr.NextChunk()
+	assert.Equal(t, " end sec", string(chunk), "Flush should release held back data")
+	tr.CommitChunk()
+
+	expected := NewTrace()
+	expected.Write([]byte("user [MASKED] token [MASKED] second [MASKED] end sec"))
+	assert.Equal(t, expected.Checksum(), tr.Checksum(), "The checksum should cover the masked trace")
+}
+
+func TestTraceLimit(t *testing.T) {
+	tr := NewTrace()
+	tr.SetLimit(10)
+	tr.Write([]byte("12345"))
+	tr.Write([]byte("67890abc"))
+	tr.Write([]byte("def"))
+	chunk, _ := tr.NextChunk()
+	assert.Equal(t, "1234567890\nJob's log exceeded limit of 10 bytes.\nJob execution will continue but no more output will be collected.\n", string(chunk))
+	tr.CommitChunk()
+	tr.Write([]byte("more"))
+	chunk, _ = tr.NextChunk()
+	assert.Len(t, chunk, 0, "Output beyond the limit should be dropped")
+	tr.CommitChunk()
+}
+
+func TestTraceLimitCut(t *testing.T) {
+	notice := "\nJob's log exceeded limit of 10 bytes.\nJob execution will continue but no more output will be collected.\n"
+
+	tr := NewTrace()
+	tr.SetLimit(10)
+	tr.Write([]byte("123456789\u00fc"))
+	chunk, _ := tr.NextChunk()
+	assert.Equal(t, "123456789"+notice, string(chunk), "A multibyte character shouldn't be split")
+
+	tr = NewTrace()
+	tr.SetLimit(10)
+	tr.Write([]byte("12345678\u20ac"))
+	chunk, _ = tr.NextChunk()
+	assert.Equal(t, "12345678"+notice, string(chunk), "A multibyte character shouldn't be split")
+
+	tr = NewTrace()
+	tr.SetLimit(10)
+	tr.SetMasked([]string{"secret"})
+	tr.Write([]byte("123\nsecret\n"))
+	chunk, _ = tr.NextChunk()
+	assert.Equal(t, "123\n"+notice, string(chunk), "The output should be cut after the last complete line")
+}
+
+func TestTraceSpill(t *testing.T) {
+	tr := NewTrace()
+	defer tr.Close()
+	tr.Write([]byte("Hello "))
+	tr.NextChunk()
+	tr.CommitChunk()
+	if !assert.NotNil(t, tr.spill, "Committed data should be moved to a file") {
+		return
+	}
+	spillFile := tr.spill.Name()
+	assert.Equal(t, 0, tr.b.Len(), "Committed data should be released from memory")
+
+	tr.Write([]byte("World"))
+	chunk, off := tr.NextChunk()
+	assert.Equal(t, "World", string(chunk))
+	assert.Equal(t, 6, off)
+	tr.Resync(3)
+	chunk, off = tr.NextChunk()
+	assert.Equal(t, "lo World", string(chunk), "Resync should read spilled data back")
+	assert.Equal(t, 3, off)
+	tr.CommitChunk()
+	assert.Equal(t, 11, tr.Len())
+	assert.Equal(t, 11, tr.Offset())
+
+	expected := NewTrace()
+	expected.Write([]byte("Hello World"))
+	assert.Equal(t, expected.Checksum(), tr.Checksum())
+	assert.NoError(t, tr.Close())
+	_, err := os.Stat(spillFile)
+	assert.True(t, os.IsNotExist(err), "Close should remove the file")
+}